@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+)
+
+// Administration commands, run as "server <command> [flags] [args]" instead of starting the server.
+var commands = map[string]func(args []string) error{
+	"jwt-keys": jwtKeysCommand,
+	"users":    usersCommand,
+	"mailbox":  mailboxCommand,
+	"servers":  serversCommand,
+	"keys":     keysCommand,
+}
+
+func isCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	_, ok := commands[args[0]]
+	return ok
+}
+
+func runCommand(args []string) error {
+	return commands[args[0]](args[1:])
+}
+
+// commandFlags returns a flag set for a command, with the same config flags as the server.
+func commandFlags(name string) (*flag.FlagSet, *string) {
+	const (
+		defaultConfig = "configs/config.json"
+		configUsage   = "Path to JSON configuration file"
+	)
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	configPath := fs.String("config", defaultConfig, configUsage)
+	fs.StringVar(configPath, "c", defaultConfig, configUsage+" (shorthand)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s:\n", os.Args[0], name)
+		fs.PrintDefaults()
+	}
+
+	return fs, configPath
+}
+
+// parseCommand parses the flags of a "<command> <subcommand>" and loads the configuration file.
+// It returns the flag set holding the remaining positional arguments.
+func parseCommand(name string, args []string) (*flag.FlagSet, *config.Config, error) {
+	fs, configPath := commandFlags(name)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fs, cfg, nil
+}
+
+// fingerprint returns the hex encoded SHA-256 of a public-key.
+func fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+)
+
+const jwtKeysUsage = "Usage: jwt-keys list | add | retire [-grace duration] <key id>"
+
+// jwtKeysCommand manages the JWT keyring stored in the configuration file.
+// Running servers only pick up the changes after a restart.
+func jwtKeysCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(jwtKeysUsage)
+	}
+
+	fs, configPath := commandFlags("jwt-keys " + args[0])
+	grace := fs.Duration("grace", 0, "How long tokens signed by the retired key stay valid (default: the refresh token lifetime)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	switch args[0] {
+	case "list":
+		active, _ := cfg.JWTKeys.Active()
+		for _, key := range cfg.JWTKeys {
+			status := "accepted"
+			if key.Retired(now) {
+				status = "retired"
+			} else if key.RetiresAt != 0 {
+				status = "retiring at " + time.Unix(key.RetiresAt, 0).UTC().Format(time.RFC3339)
+			} else if active != nil && key.Id == active.Id {
+				status = "active"
+			}
+
+			fmt.Printf("%s\tcreated %s\t%s\n", key.Id, time.Unix(key.CreatedAt, 0).UTC().Format(time.RFC3339), status)
+		}
+		return nil
+
+	case "add":
+		key, err := crypto.NewJWTKey()
+		if err != nil {
+			return err
+		}
+
+		cfg.JWTKeys = append(cfg.JWTKeys, key)
+		fmt.Printf("Added JWT key %s, new tokens are signed with it once the server is restarted\n", key.Id)
+
+	case "retire":
+		if fs.NArg() != 1 {
+			return errors.New(jwtKeysUsage)
+		}
+
+		if *grace == 0 {
+			*grace = time.Duration(cfg.TokenLifetimes.RefreshSeconds) * time.Second
+		}
+
+		key, err := cfg.JWTKeys.Lookup(fs.Arg(0), now)
+		if err != nil {
+			return err
+		}
+
+		key.RetiresAt = now + int64(grace.Seconds())
+		if _, err := cfg.JWTKeys.Active(); err != nil && cfg.TokenMode != "ml-dsa-87" {
+			return fmt.Errorf("JWT key (%s) is the only active key, add a new key before retiring it", key.Id)
+		}
+
+		fmt.Printf("JWT key %s retires at %s\n", key.Id, time.Unix(key.RetiresAt, 0).UTC().Format(time.RFC3339))
+
+	default:
+		return errors.New(jwtKeysUsage)
+	}
+
+	cfg.JWTKeys = pruneRetiredKeys(cfg.JWTKeys, now)
+	return cfg.Write(*configPath)
+}
+
+// pruneRetiredKeys drops keys whose grace period is over, they can no longer verify any token.
+func pruneRetiredKeys(keyring crypto.JWTKeyring, now int64) crypto.JWTKeyring {
+	kept := crypto.JWTKeyring{}
+	for _, key := range keyring {
+		if !key.Retired(now) {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
+)
+
+const keysUsage = "Usage: keys show | rotate [-retire-after duration]"
+
+// keysCommand shows and rotates the server's identity key, as served by /federation/info.
+// Running servers only pick up a rotation after a restart.
+func keysCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(keysUsage)
+	}
+
+	fs, configPath := commandFlags("keys " + args[0])
+	retireAfter := fs.Duration("retire-after", 0, "How long the previous key keeps vouching for the new one (default: ML_DSA_87_Key_Retirement_Hours)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	switch args[0] {
+	case "show":
+		return showKeys(cfg, now)
+
+	case "rotate":
+		if *retireAfter < 0 {
+			return errors.New("-retire-after must not be negative")
+		}
+
+		if *retireAfter == 0 {
+			*retireAfter = time.Duration(cfg.DSAKeyRetirement) * time.Hour
+		}
+
+		publicKey, privateKey, err := crypto.CreateDSAKeyPair()
+		if err != nil {
+			return err
+		}
+
+		publicKeyBytes, err := publicKey.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		privateKeyBytes, err := privateKey.MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		previous := crypto.PreviousDSAKey{
+			PrivateKey: cfg.DSAPrivateKey,
+			ReplacedBy: publicKeyBytes,
+			ReplacedAt: now,
+			RetiresAt:  now + int64(retireAfter.Seconds()),
+		}
+
+		cfg.DSAPreviousKeys = append(pruneRetiredDSAKeys(cfg.DSAPreviousKeys, now), previous)
+		cfg.DSAPrivateKey = privateKeyBytes
+
+		if err := cfg.Write(*configPath); err != nil {
+			return err
+		}
+
+		fmt.Printf("Rotated ML-DSA-87 key to %s, served once the server is restarted\n", fingerprint(publicKeyBytes))
+		fmt.Printf("The previous key vouches for it until %s\n", time.Unix(previous.RetiresAt, 0).UTC().Format(time.RFC3339))
+		return nil
+
+	default:
+		return errors.New(keysUsage)
+	}
+}
+
+func showKeys(cfg *config.Config, now int64) error {
+	privateKey, err := crypto.PrivateKeyFromBytes(cfg.DSAPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := privateKey.Public().(*mldsa87.PublicKey).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	tokenMode := cfg.TokenMode
+	if tokenMode == "" {
+		tokenMode = "hmac"
+	}
+
+	fmt.Printf("Domain:\t\t%s\n", cfg.DomainOrIP)
+	fmt.Printf("Token mode:\t%s\n", tokenMode)
+	fmt.Printf("ML-DSA-87 public-key fingerprint:\t%s\n", fingerprint(publicKey))
+	fmt.Printf("ML-DSA-87 public-key:\n%s\n", base64.StdEncoding.EncodeToString(publicKey))
+
+	for _, previous := range cfg.DSAPreviousKeys {
+		previousPrivateKey, err := crypto.PrivateKeyFromBytes(previous.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		previousPublicKey, err := previousPrivateKey.Public().(*mldsa87.PublicKey).MarshalBinary()
+		if err != nil {
+			return err
+		}
+
+		status := "retiring at " + time.Unix(previous.RetiresAt, 0).UTC().Format(time.RFC3339)
+		if previous.Retired(now) {
+			status = "retired"
+		}
+
+		fmt.Printf("Previous key %s\treplaced %s by %s\t%s\n", fingerprint(previousPublicKey),
+			time.Unix(previous.ReplacedAt, 0).UTC().Format(time.RFC3339), fingerprint(previous.ReplacedBy), status)
+	}
+
+	return nil
+}
+
+// pruneRetiredDSAKeys drops previous keys whose retirement is over, peers still pinning them must be told to forget us.
+func pruneRetiredDSAKeys(keys []crypto.PreviousDSAKey, now int64) []crypto.PreviousDSAKey {
+	var kept []crypto.PreviousDSAKey
+	for _, key := range keys {
+		if !key.Retired(now) {
+			kept = append(kept, key)
+		}
+	}
+	return kept
+}
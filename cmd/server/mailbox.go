@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
+)
+
+const mailboxUsage = "Usage: mailbox stats [user id] | purge <user id>"
+
+// mailboxCommand inspects and empties the undelivered data held in the Data storage.
+func mailboxCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(mailboxUsage)
+	}
+
+	fs, cfg, err := parseCommand("mailbox "+args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	store, err := data.OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.ExitCleanup()
+
+	switch args[0] {
+	case "stats":
+		if fs.NArg() > 1 {
+			return errors.New(mailboxUsage)
+		}
+
+		var totalBytes, count int64
+		if fs.NArg() == 1 {
+			totalBytes, count, err = store.GetMailboxUsage(fs.Arg(0))
+		} else {
+			totalBytes, count, err = store.GetTotalUsage()
+		}
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d messages, %d bytes\n", count, totalBytes)
+
+	case "purge":
+		if fs.NArg() != 1 {
+			return errors.New(mailboxUsage)
+		}
+
+		purged, err := store.PurgeMailbox(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Purged %d messages\n", purged)
+
+	default:
+		return errors.New(mailboxUsage)
+	}
+
+	return nil
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/certs"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/httpserver"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/metrics"
 )
 
 type CLIFlags struct {
@@ -54,6 +63,14 @@ func parseFlags() (*CLIFlags, error) {
 }
 
 func main() {
+	if isCommand(os.Args[1:]) {
+		if err := runCommand(os.Args[1:]); err != nil {
+			slog.Error("Command failed", "command", os.Args[1], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flags, err := parseFlags()
 	if err != nil {
 		slog.Error("Invalid CLI flags", "error", err)
@@ -73,7 +90,21 @@ func main() {
 		os.Exit(1)
 	}
 
-	dataSvc, err := data.NewDataService(cfg, userSvc.Store)
+	// Loaded before the data service, whose federation client presents our certificate.
+	var (
+		reloader        *certs.Reloader
+		clientTLSConfig *tls.Config
+	)
+	if cfg.TLS.Enabled {
+		reloader, err = certs.New(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile, cfg.TLS.MinVersion)
+		if err != nil {
+			slog.Error("Error while loading TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		clientTLSConfig = reloader.ClientConfig()
+	}
+
+	dataSvc, err := data.NewDataService(cfg, userSvc.Store, clientTLSConfig)
 	if err != nil {
 		slog.Error("Error while initializing DataStorage service", "error", err)
 		os.Exit(1)
@@ -84,10 +115,6 @@ func main() {
 		DataService: dataSvc,
 	}
 
-	// Ensures the database services closes properly before the server exits.
-	defer dbSvcs.UserService.Store.ExitCleanup()
-	defer dbSvcs.DataService.Store.ExitCleanup()
-
 	// Clears up all previous challenges, clean slate basically.
 	dbSvcs.UserService.Store.CleanupChallenges()
 
@@ -97,10 +124,91 @@ func main() {
 		"configPath", flags.ConfigPath,
 	)
 
-	srv := httpserver.New(flags.Host, flags.Port, cfg, &dbSvcs)
-	if err := srv.Start(); err != nil {
-		slog.Error("server crashed", "error", err)
+	srv, err := httpserver.New(flags.Host, flags.Port, cfg, &dbSvcs)
+	if err != nil {
+		slog.Error("Error while signing our key rotations", "error", err)
 		os.Exit(1)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if reloader != nil {
+		srv.EnableTLS(reloader)
+		go reloader.Watch(ctx, time.Second*constants.TLS_RELOAD_CHECK_INTERVAL)
+		go reloadOnSIGHUP(ctx, reloader)
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		serveErr <- srv.Start()
+	}()
+
+	var metricsSrv *http.Server
+	if cfg.Metrics.Enabled && cfg.Metrics.ListenAddress != "" {
+		slog.Info("Serving metrics", "address", cfg.Metrics.ListenAddress)
+		metricsSrv = metrics.NewServer(cfg.Metrics.ListenAddress)
+		go func() {
+			serveErr <- metricsSrv.ListenAndServe()
+		}()
+	}
+
+	exitCode := 0
+	select {
+	case err := <-serveErr:
+		slog.Error("server crashed", "error", err)
+		exitCode = 1
+	case <-ctx.Done():
+		// A second signal kills the process right away.
+		stop()
+		slog.Info("Shutting down, draining connections", "timeout", constants.SHUTDOWN_TIMEOUT)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*constants.SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error while shutting down the HTTP server", "error", err)
+	}
+
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Error while shutting down the metrics server", "error", err)
+		}
+	}
+
+	if err := dataSvc.Close(shutdownCtx); err != nil {
+		slog.Error("Error while closing DataStorage", "error", err)
+	}
+
+	if err := userSvc.Close(); err != nil {
+		slog.Error("Error while closing UserStorage", "error", err)
+	}
+
+	slog.Info("Server stopped")
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// reloadOnSIGHUP reloads the TLS certificate every time the process receives SIGHUP.
+func reloadOnSIGHUP(ctx context.Context, reloader *certs.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		if err := reloader.Reload(); err != nil {
+			slog.Error("Error while reloading TLS certificate, keeping the previous one", "error", err)
+			continue
+		}
+
+		slog.Info("Reloaded TLS certificate on SIGHUP")
+	}
 }
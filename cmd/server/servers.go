@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+)
+
+const serversUsage = "Usage: servers list | forget <url>"
+
+// serversCommand manages the federated server keys cached in the User storage.
+func serversCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(serversUsage)
+	}
+
+	fs, cfg, err := parseCommand("servers "+args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	store, err := authenticate.OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.ExitCleanup()
+
+	switch args[0] {
+	case "list":
+		servers, err := store.ListServers()
+		if err != nil {
+			return err
+		}
+
+		for _, server := range servers {
+			fmt.Printf("%s\trefetch %s\t%s\n", server.Url, server.RefetchDate, fingerprint(server.PublicKey))
+		}
+
+	case "forget":
+		if fs.NArg() != 1 {
+			return errors.New(serversUsage)
+		}
+
+		url := strings.ToLower(strings.TrimSpace(fs.Arg(0)))
+
+		deleted, err := store.DeleteServerInfo(url)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("Server (%s) is not known", url)
+		}
+
+		fmt.Printf("Forgot server %s, its key is fetched again on its next request\n", url)
+
+	default:
+		return errors.New(serversUsage)
+	}
+
+	return nil
+}
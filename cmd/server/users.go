@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
+)
+
+const usersUsage = "Usage: users list | show <user id> | delete <user id> | ban <user id> | unban <user id>"
+
+// usersCommand manages the accounts stored in the User storage.
+func usersCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usersUsage)
+	}
+
+	fs, cfg, err := parseCommand("users "+args[0], args[1:])
+	if err != nil {
+		return err
+	}
+
+	store, err := authenticate.OpenStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.ExitCleanup()
+
+	if args[0] == "list" {
+		ids, err := store.ListUsers()
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New(usersUsage)
+	}
+	userId := fs.Arg(0)
+
+	switch args[0] {
+	case "show":
+		publicKey, err := store.GetUserPublicKeyById(userId)
+		if err != nil {
+			return err
+		}
+		if publicKey == nil {
+			return fmt.Errorf("User (%s) does not exist", userId)
+		}
+
+		bannedAt, err := store.GetUserBan(userId)
+		if err != nil {
+			return err
+		}
+
+		devices, err := store.ListDevices(userId)
+		if err != nil {
+			return err
+		}
+
+		dataStore, err := data.OpenStorage(cfg)
+		if err != nil {
+			return err
+		}
+		defer dataStore.ExitCleanup()
+
+		totalBytes, count, err := dataStore.GetMailboxUsage(userId)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("User ID:\t%s\n", userId)
+		fmt.Printf("Public-key:\t%s\n", fingerprint(publicKey))
+		if bannedAt != 0 {
+			fmt.Printf("Banned:\t\tsince %s\n", time.Unix(bannedAt, 0).UTC().Format(time.RFC3339))
+		} else {
+			fmt.Printf("Banned:\t\tno\n")
+		}
+		fmt.Printf("Mailbox:\t%d messages, %d bytes\n", count, totalBytes)
+		for _, device := range devices {
+			fmt.Printf("Device:\t\t%s %s, added %s\n", device.Id, fingerprint(device.PublicKey), time.Unix(device.CreatedAt, 0).UTC().Format(time.RFC3339))
+		}
+
+	case "delete":
+		deleted, err := store.DeleteUser(userId, time.Now().Unix()+int64(cfg.UserIdCooldown)*3600)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return fmt.Errorf("User (%s) does not exist", userId)
+		}
+
+		dataStore, err := data.OpenStorage(cfg)
+		if err != nil {
+			return err
+		}
+		defer dataStore.ExitCleanup()
+
+		purged, err := dataStore.PurgeMailbox(userId)
+		if err != nil {
+			return fmt.Errorf("User (%s) was deleted, but purging its mailbox failed: %w", userId, err)
+		}
+
+		fmt.Printf("Deleted user %s and %d undelivered messages\n", userId, purged)
+
+	case "ban":
+		now := time.Now().Unix()
+
+		exists, err := store.SetUserBan(userId, now)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("User (%s) does not exist", userId)
+		}
+
+		// Log the user out everywhere, tokens issued later during the current millisecond included.
+		if err := store.RevokeUserTokens(userId, time.Now().UnixMilli()+1); err != nil {
+			return err
+		}
+
+		fmt.Printf("Banned user %s and revoked all of its tokens\n", userId)
+
+	case "unban":
+		exists, err := store.SetUserBan(userId, 0)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("User (%s) does not exist", userId)
+		}
+
+		fmt.Printf("Unbanned user %s\n", userId)
+
+	default:
+		return errors.New(usersUsage)
+	}
+
+	return nil
+}
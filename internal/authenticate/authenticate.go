@@ -1,58 +1,147 @@
 package authenticate
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"encoding/base64"
-
+	"errors"
 	"fmt"
+	"log/slog"
+	"time"
 
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/metrics"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/mysql"
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/sqlite"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/backends"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
 )
 
+// ErrUserBanned is returned when a banned user tries to authenticate.
+var ErrUserBanned = errors.New("User is banned")
+
+// ErrInvalidKeyRotation is returned when a public-key rotation is not properly signed.
+var ErrInvalidKeyRotation = errors.New("Invalid public-key rotation")
+
 type UserService struct {
 	Store storage.UserStorage
 	Cfg   *config.Config
+
+	// Server identity key, signs tokens in ml-dsa-87 token mode, and verifies them in every mode.
+	dsaPrivateKey *mldsa87.PrivateKey
+	dsaPublicKey  *mldsa87.PublicKey
+
+	// Keys rotated away from keep verifying the tokens they signed until they retire.
+	previousDSAKeys []previousDSAKey
+
+	stopJanitor context.CancelFunc
+}
+
+type previousDSAKey struct {
+	publicKey *mldsa87.PublicKey
+	retiresAt int64
+}
+
+// OpenStorage connects to the configured UserStorage backend.
+func OpenStorage(cfg *config.Config) (storage.UserStorage, error) {
+	return backends.Open(cfg.UserStorage, cfg)
 }
 
 func NewUserService(cfg *config.Config) (*UserService, error) {
-	var s storage.UserStorage
-	switch cfg.UserStorage {
-	case "internal", "sqlite":
-		sqliteStore, err := sqlite.New(constants.SQLITE_DB_NAME)
+	s, err := OpenStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s = metrics.NewUserStorage(cfg.UserStorage, s)
+
+	dsaPrivateKey, err := crypto.PrivateKeyFromBytes(cfg.DSAPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Retired keys are only kept in the config until the next rotation prunes them.
+	now := time.Now().Unix()
+
+	var previousDSAKeys []previousDSAKey
+	for _, previous := range cfg.DSAPreviousKeys {
+		if previous.Retired(now) {
+			continue
+		}
+
+		previousPrivateKey, err := crypto.PrivateKeyFromBytes(previous.PrivateKey)
 		if err != nil {
 			return nil, err
 		}
-		s = sqliteStore
 
-	case "mysql", "sql", "mariadb":
-		sqlCfg := mysql.SQLDSN{
-			User:                 cfg.SQL.DBUser,
-			Passwd:               cfg.SQL.DBPassword,
-			Net:                  "tcp",
-			Addr:                 fmt.Sprintf("%s:%d", cfg.SQL.Host, cfg.SQL.Port),
-			DBName:               cfg.SQL.DBName,
-			ParseTime:            false,
-			AllowNativePasswords: true,
-			Collation:            "utf8mb4_unicode_ci",
+		previousDSAKeys = append(previousDSAKeys, previousDSAKey{
+			publicKey: previousPrivateKey.Public().(*mldsa87.PublicKey),
+			retiresAt: previous.RetiresAt,
+		})
+	}
+
+	ctx, stopJanitor := context.WithCancel(context.Background())
+
+	svc := &UserService{
+		Store:           s,
+		Cfg:             cfg,
+		dsaPrivateKey:   dsaPrivateKey,
+		dsaPublicKey:    dsaPrivateKey.Public().(*mldsa87.PublicKey),
+		previousDSAKeys: previousDSAKeys,
+		stopJanitor:     stopJanitor,
+	}
+
+	go svc.runJanitor(ctx)
+
+	return svc, nil
+}
+
+// Close stops the janitor and closes the storage.
+func (svc *UserService) Close() error {
+	svc.stopJanitor()
+	return svc.Store.ExitCleanup()
+}
+
+// runJanitor periodically deletes challenges that expired without being verified,
+// revoked tokens that have expired anyway, and reservations of deleted user IDs.
+func (svc *UserService) runJanitor(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * constants.USER_JANITOR_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
-		sqlStore, err := mysql.New(sqlCfg)
+		now := time.Now().Unix()
+
+		purged, err := svc.Store.PurgeExpiredChallenges(now)
 		if err != nil {
-			return nil, err
+			slog.Error("Error while purging expired challenges", "error", err)
+		} else if purged > 0 {
+			slog.Debug("Purged expired challenges", "count", purged)
 		}
-		s = sqlStore
 
-	default:
-		return nil, fmt.Errorf("Unknown UserStorage type (%s)", cfg.UserStorage)
-	}
+		purged, err = svc.Store.PurgeExpiredRevocations(now)
+		if err != nil {
+			slog.Error("Error while purging expired token revocations", "error", err)
+		} else if purged > 0 {
+			slog.Debug("Purged expired token revocations", "count", purged)
+		}
 
-	return &UserService{Store: s, Cfg: cfg}, nil
+		purged, err = svc.Store.PurgeExpiredReservations(now)
+		if err != nil {
+			slog.Error("Error while purging expired user ID reservations", "error", err)
+		} else if purged > 0 {
+			slog.Debug("Purged expired user ID reservations", "count", purged)
+		}
+	}
 }
 
 // Authentication initialization processor
@@ -62,6 +151,9 @@ func (svc *UserService) AuthenticateInitProcessor(payload *types.AuthenticateIni
 		return "", err
 	}
 
+	createdAt := time.Now().Unix()
+	expiresAt := createdAt + int64(svc.Cfg.ChallengeTTL)
+
 	if payload.PublicKey != "" {
 		decodedPublicKey, err := base64.StdEncoding.DecodeString(payload.PublicKey)
 		if err != nil {
@@ -72,9 +164,22 @@ func (svc *UserService) AuthenticateInitProcessor(payload *types.AuthenticateIni
 			return "", fmt.Errorf("Public-Key length (%d) does not match ML-DSA-87 public-key standard NIST length (%d)!", len(decodedPublicKey), constants.ML_DSA_87_PK_LEN)
 		}
 
-		err = svc.Store.SaveChallenge(challengeBytes, nil, decodedPublicKey)
+		err = svc.Store.SaveChallenge(challengeBytes, nil, decodedPublicKey, createdAt, expiresAt)
+	} else if payload.DeviceID != "" && payload.DeviceID != constants.PRIMARY_DEVICE_ID {
+		// The challenge carries the device's key, so it is the one verifying the signature.
+		var devicePublicKey []byte
+		devicePublicKey, err = svc.Store.GetDevicePublicKey(payload.UserID, payload.DeviceID)
+		if err != nil {
+			return "", err
+		}
+
+		if devicePublicKey == nil {
+			return "", fmt.Errorf("Device (%s) of user (%s) does not exist", payload.DeviceID, payload.UserID)
+		}
+
+		err = svc.Store.SaveChallenge(challengeBytes, payload.UserID, devicePublicKey, createdAt, expiresAt)
 	} else {
-		err = svc.Store.SaveChallenge(challengeBytes, payload.UserID, nil)
+		err = svc.Store.SaveChallenge(challengeBytes, payload.UserID, nil, createdAt, expiresAt)
 	}
 
 	if err != nil {
@@ -86,38 +191,170 @@ func (svc *UserService) AuthenticateInitProcessor(payload *types.AuthenticateIni
 	return challengeEncoded, nil
 }
 
-// Authentication verification processor
+// Authentication verification processor, the challenge must have been issued for payload's device, the primary one if unset.
 func (svc *UserService) AuthenticateVerificationProcessor(payload *types.AuthenticateVerificationRequest) (string, []byte, bool, error) {
-	decodedSignature, err := base64.StdEncoding.DecodeString(payload.Signature)
+	decodedSignature, err := decodeSignature(payload.Signature)
 	if err != nil {
 		return "", nil, false, err
 	}
 
-	if len(decodedSignature) != constants.ML_DSA_87_SIGN_LEN {
-		return "", nil, false, fmt.Errorf("Signature length (%d) does not match ML-DSA-87 signature standard NIST length (%d)!", len(decodedSignature), constants.ML_DSA_87_SIGN_LEN)
+	decodedChallenge, publicKey, userId, err := svc.consumeChallenge(payload.Challenge)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	deviceId := cmp.Or(payload.DeviceID, constants.PRIMARY_DEVICE_ID)
+
+	if userId == "" && deviceId != constants.PRIMARY_DEVICE_ID {
+		return "", nil, false, errors.New("Devices can only be added to existing users")
+	}
+
+	if userId != "" {
+		// Also rejects devices removed since the challenge was issued.
+		devicePublicKey, err := svc.DevicePublicKey(userId, deviceId)
+		if err != nil {
+			return "", nil, false, err
+		}
+
+		if !bytes.Equal(devicePublicKey, publicKey) {
+			return "", nil, false, fmt.Errorf("Challenge was not issued for device (%s) of user (%s)", deviceId, userId)
+		}
 	}
 
-	decodedChallenge, err := base64.StdEncoding.DecodeString(payload.Challenge)
+	publicKeyParsed, err := crypto.PublicKeyFromBytes(publicKey)
 	if err != nil {
 		return "", nil, false, err
+	}
 
+	return userId, publicKey, crypto.VerifySignature(publicKeyParsed, decodedChallenge, nil, decodedSignature), nil
+}
+
+// RotateKeyProcessor replaces a user's public-key. Both the current and the new key must sign
+// the challenge followed by the new public-key. It returns the user ID once the key was replaced, along with
+// a new token pair for the primary device, and ErrInvalidKeyRotation if a signature is invalid.
+func (svc *UserService) RotateKeyProcessor(payload *types.AuthenticateRotateKeyRequest) (string, *TokenPair, error) {
+	decodedSignature, err := decodeSignature(payload.Signature)
+	if err != nil {
+		return "", nil, err
 	}
 
-	if len(decodedChallenge) != constants.CHALLENGE_LEN {
-		return "", nil, false, fmt.Errorf("Challenge length (%d) does not match our defined length (%d)!", len(decodedChallenge), constants.CHALLENGE_LEN)
+	decodedNewSignature, err := decodeSignature(payload.NewSignature)
+	if err != nil {
+		return "", nil, err
 	}
 
-	publicKey, userId, err := svc.Store.GetChallengeData(decodedChallenge)
+	newPublicKey, err := base64.StdEncoding.DecodeString(payload.NewPublicKey)
 	if err != nil {
-		return "", nil, false, err
+		return "", nil, err
+	}
+
+	if len(newPublicKey) != constants.ML_DSA_87_PK_LEN {
+		return "", nil, fmt.Errorf("Public-Key length (%d) does not match ML-DSA-87 public-key standard NIST length (%d)!", len(newPublicKey), constants.ML_DSA_87_PK_LEN)
+	}
+
+	newPublicKeyParsed, err := crypto.PublicKeyFromBytes(newPublicKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	decodedChallenge, publicKey, userId, err := svc.consumeChallenge(payload.Challenge)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if userId == "" {
+		return "", nil, fmt.Errorf("%w: challenge was not issued for a user ID", ErrInvalidKeyRotation)
+	}
+
+	if bytes.Equal(publicKey, newPublicKey) {
+		return "", nil, fmt.Errorf("%w: new public-key is the current one", ErrInvalidKeyRotation)
 	}
 
 	publicKeyParsed, err := crypto.PublicKeyFromBytes(publicKey)
 	if err != nil {
-		return "", nil, false, err
+		return "", nil, err
 	}
 
-	return userId, publicKey, crypto.VerifySignature(publicKeyParsed, decodedChallenge, nil, decodedSignature), nil
+	signedData := append(decodedChallenge, newPublicKey...)
+
+	if !crypto.VerifySignature(publicKeyParsed, signedData, nil, decodedSignature) {
+		return "", nil, fmt.Errorf("%w: invalid signature of the current key", ErrInvalidKeyRotation)
+	}
+
+	if !crypto.VerifySignature(newPublicKeyParsed, signedData, nil, decodedNewSignature) {
+		return "", nil, fmt.Errorf("%w: invalid signature of the new key", ErrInvalidKeyRotation)
+	}
+
+	rotated, err := svc.Store.UpdateUserPublicKey(userId, publicKey, newPublicKey)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !rotated {
+		return "", nil, fmt.Errorf("%w: public-key of (%s) changed during the rotation", ErrInvalidKeyRotation, userId)
+	}
+
+	// Sessions opened with the old key, possibly by whoever compromised it, are logged out, including the ones
+	// opened later during the current millisecond. The caller's new tokens are only issued once it is over, so
+	// they are the only ones left valid.
+	revokedBefore := time.Now().UnixMilli() + 1
+	if err := svc.Store.RevokeUserTokens(userId, revokedBefore); err != nil {
+		return "", nil, err
+	}
+	time.Sleep(time.Until(time.UnixMilli(revokedBefore)))
+
+	tokens, err := svc.IssueTokens(userId, constants.PRIMARY_DEVICE_ID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return userId, tokens, nil
+}
+
+func decodeSignature(signature string) ([]byte, error) {
+	decodedSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(decodedSignature) != constants.ML_DSA_87_SIGN_LEN {
+		return nil, fmt.Errorf("Signature length (%d) does not match ML-DSA-87 signature standard NIST length (%d)!", len(decodedSignature), constants.ML_DSA_87_SIGN_LEN)
+	}
+
+	return decodedSignature, nil
+}
+
+// consumeChallenge decodes and consumes a challenge issued by AuthenticateInitProcessor, it returns the challenge
+// along with the public-key and user ID it was issued for. The user ID is empty for new registrations.
+func (svc *UserService) consumeChallenge(challenge string) ([]byte, []byte, string, error) {
+	decodedChallenge, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if len(decodedChallenge) != constants.CHALLENGE_LEN {
+		return nil, nil, "", fmt.Errorf("Challenge length (%d) does not match our defined length (%d)!", len(decodedChallenge), constants.CHALLENGE_LEN)
+	}
+
+	// Consuming the challenge before verifying the signature means every challenge
+	// gets exactly one verification attempt, whether it succeeds or not.
+	publicKey, userId, err := svc.Store.ConsumeChallenge(decodedChallenge, time.Now().Unix())
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if userId != "" {
+		bannedAt, err := svc.Store.GetUserBan(userId)
+		if err != nil {
+			return nil, nil, "", err
+		}
+
+		if bannedAt != 0 {
+			return nil, nil, "", fmt.Errorf("%w: (%s) since %s", ErrUserBanned, userId, time.Unix(bannedAt, 0).UTC().Format(time.RFC3339))
+		}
+	}
+
+	return decodedChallenge, publicKey, userId, nil
 }
 
 func (svc *UserService) RegisterNewUser(publicKey []byte) (string, error) {
@@ -136,7 +373,16 @@ func (svc *UserService) RegisterNewUser(publicKey []byte) (string, error) {
 		if err != nil {
 			return "", err
 		}
-		if !exists {
+		if exists {
+			continue
+		}
+
+		// IDs of deleted users are not reissued before the cooldown is over, so they can't receive data meant for them.
+		reserved, err := svc.Store.IsUserIdReserved(userId, time.Now().Unix())
+		if err != nil {
+			return "", err
+		}
+		if !reserved {
 			break
 		}
 	}
@@ -144,3 +390,10 @@ func (svc *UserService) RegisterNewUser(publicKey []byte) (string, error) {
 	err = svc.Store.SaveUser(userId, publicKey)
 	return userId, err
 }
+
+// DeleteAccount deletes the user, which invalidates all of its tokens, and reserves its ID for the reuse cooldown.
+// It returns false if the user did not exist.
+func (svc *UserService) DeleteAccount(userId string) (bool, error) {
+	reservedUntil := time.Now().Unix() + int64(svc.Cfg.UserIdCooldown)*3600
+	return svc.Store.DeleteUser(userId, reservedUntil)
+}
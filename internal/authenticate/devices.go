@@ -0,0 +1,114 @@
+package authenticate
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+)
+
+// ErrInvalidDevice is returned when a device can't be added or removed.
+var ErrInvalidDevice = errors.New("Invalid device")
+
+// ErrTooManyDevices is returned when the user already has the maximum number of devices.
+var ErrTooManyDevices = errors.New("Too many devices")
+
+// DevicePublicKey returns the public-key of one of the user's devices, or nil if it has no such device.
+// The primary device's key is the one the user registered with.
+func (svc *UserService) DevicePublicKey(userId string, deviceId string) ([]byte, error) {
+	if deviceId == constants.PRIMARY_DEVICE_ID {
+		return svc.Store.GetUserPublicKeyById(userId)
+	}
+	return svc.Store.GetDevicePublicKey(userId, deviceId)
+}
+
+// ListDevices returns the user's devices, starting with the primary one.
+func (svc *UserService) ListDevices(userId string) ([]storage.Device, error) {
+	publicKey, err := svc.Store.GetUserPublicKeyById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if publicKey == nil {
+		return nil, fmt.Errorf("User (%s) does not exist", userId)
+	}
+
+	devices, err := svc.Store.ListDevices(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]storage.Device{{Id: constants.PRIMARY_DEVICE_ID, PublicKey: publicKey}}, devices...), nil
+}
+
+// AddDevice registers the key that signed the payload's challenge as a new device of userId, and returns its ID.
+// The challenge must have been issued for that public-key, the same way new users register.
+func (svc *UserService) AddDevice(userId string, payload *types.DeviceAddRequest) (string, error) {
+	decodedSignature, err := decodeSignature(payload.Signature)
+	if err != nil {
+		return "", err
+	}
+
+	decodedChallenge, publicKey, challengeUserId, err := svc.consumeChallenge(payload.Challenge)
+	if err != nil {
+		return "", err
+	}
+
+	if challengeUserId != "" {
+		return "", fmt.Errorf("%w: challenge was not issued for a new public-key", ErrInvalidDevice)
+	}
+
+	publicKeyParsed, err := crypto.PublicKeyFromBytes(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	if !crypto.VerifySignature(publicKeyParsed, decodedChallenge, nil, decodedSignature) {
+		return "", fmt.Errorf("%w: invalid signature of the new device", ErrInvalidDevice)
+	}
+
+	devices, err := svc.ListDevices(userId)
+	if err != nil {
+		return "", err
+	}
+
+	if uint32(len(devices)) >= svc.Cfg.Devices.MaxDevices {
+		return "", fmt.Errorf("%w: user (%s) has %d devices", ErrTooManyDevices, userId, len(devices))
+	}
+
+	for _, device := range devices {
+		if bytes.Equal(device.PublicKey, publicKey) {
+			return "", fmt.Errorf("%w: public-key is already device (%s)", ErrInvalidDevice, device.Id)
+		}
+	}
+
+	deviceIdBytes, err := utils.SecureRandomBytes(constants.DEVICE_ID_LEN)
+	if err != nil {
+		return "", err
+	}
+
+	deviceId := hex.EncodeToString(deviceIdBytes)
+
+	if err := svc.Store.AddDevice(userId, deviceId, publicKey, time.Now().Unix()); err != nil {
+		return "", err
+	}
+
+	return deviceId, nil
+}
+
+// RemoveDevice removes one of the user's additional devices, whose tokens stop being valid right away.
+// It returns false if the user has no such device.
+func (svc *UserService) RemoveDevice(userId string, deviceId string) (bool, error) {
+	if deviceId == constants.PRIMARY_DEVICE_ID {
+		return false, fmt.Errorf("%w: the primary device can't be removed", ErrInvalidDevice)
+	}
+
+	return svc.Store.RemoveDevice(userId, deviceId)
+}
@@ -0,0 +1,205 @@
+package authenticate
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Values of the "token_type" claim, access tokens authorize requests, refresh tokens only mint new token pairs.
+const (
+	AccessToken  = "access"
+	RefreshToken = "refresh"
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, expired, revoked or of the wrong type.
+var ErrInvalidToken = errors.New("Invalid or expired token")
+
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	// Seconds until AccessToken expires.
+	ExpiresIn int64
+	// Device both tokens are bound to.
+	DeviceId string
+}
+
+// IssueTokens creates a new access and refresh token pair for one of userId's devices.
+func (svc *UserService) IssueTokens(userId string, deviceId string) (*TokenPair, error) {
+	now := time.Now()
+	accessLifetime := int64(svc.Cfg.TokenLifetimes.AccessSeconds)
+
+	accessToken, err := svc.createToken(userId, deviceId, AccessToken, now, accessLifetime)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := svc.createToken(userId, deviceId, RefreshToken, now, int64(svc.Cfg.TokenLifetimes.RefreshSeconds))
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken, ExpiresIn: accessLifetime, DeviceId: deviceId}, nil
+}
+
+// ClaimsDeviceId returns the device a validated token is bound to. Tokens issued before devices existed belong to the primary device.
+func ClaimsDeviceId(claims jwt.MapClaims) string {
+	if deviceId, ok := claims["device_id"].(string); ok && deviceId != "" {
+		return deviceId
+	}
+	return constants.PRIMARY_DEVICE_ID
+}
+
+func (svc *UserService) createToken(userId string, deviceId string, tokenType string, now time.Time, lifetime int64) (string, error) {
+	jti, err := utils.SecureRandomBytes(constants.JWT_ID_LEN)
+	if err != nil {
+		return "", err
+	}
+
+	// iat has a millisecond resolution, so that revoking every token of a user can spare the ones issued right after.
+	claims := map[string]interface{}{
+		"user_id":    userId,
+		"device_id":  deviceId,
+		"token_type": tokenType,
+		"jti":        hex.EncodeToString(jti),
+		"iat":        float64(now.UnixMilli()) / 1000,
+		"exp":        now.Unix() + lifetime,
+	}
+
+	if svc.Cfg.TokenMode == "ml-dsa-87" {
+		return crypto.CreateMLDSAToken(claims, svc.dsaPrivateKey)
+	}
+
+	key, err := svc.Cfg.JWTKeys.Active()
+	if err != nil {
+		return "", err
+	}
+
+	return crypto.CreateJWTToken(claims, key)
+}
+
+// ValidateToken verifies the token's signature, expiry and type, and that it has not been revoked.
+// Errors wrapping ErrInvalidToken mean the token must be rejected, any other error is a storage failure.
+func (svc *UserService) ValidateToken(tokenString string, tokenType string) (jwt.MapClaims, error) {
+	token, claims, err := crypto.VerifyJWT(tokenString, svc.Cfg.JWTKeys, svc.dsaPublicKeys(time.Now().Unix())...)
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	userId, _ := claims["user_id"].(string)
+	jti, _ := claims["jti"].(string)
+	if userId == "" || jti == "" || claims["token_type"] != tokenType {
+		return nil, fmt.Errorf("%w: missing claims or wrong token type", ErrInvalidToken)
+	}
+
+	if err := svc.RecheckToken(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// RecheckToken checks that a token validated earlier is still valid: not expired, not revoked, and not bound to a
+// removed device. Long-lived streams call it to end once their token is no longer accepted.
+// Errors wrapping ErrInvalidToken mean the token must be rejected, any other error is a storage failure.
+func (svc *UserService) RecheckToken(claims jwt.MapClaims) error {
+	userId, _ := claims["user_id"].(string)
+	jti, _ := claims["jti"].(string)
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil || !expiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: token is expired", ErrInvalidToken)
+	}
+
+	// Read as is, the jwt package truncates it to the second.
+	issuedAt, ok := claims["iat"].(float64)
+	if !ok {
+		return fmt.Errorf("%w: missing issued at claim", ErrInvalidToken)
+	}
+
+	revoked, err := svc.Store.IsTokenRevoked(jti, userId, int64(math.Round(issuedAt*1000)))
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return fmt.Errorf("%w: token (%s) is revoked", ErrInvalidToken, jti)
+	}
+
+	// Tokens of removed devices are rejected along with the device.
+	if deviceId := ClaimsDeviceId(claims); deviceId != constants.PRIMARY_DEVICE_ID {
+		publicKey, err := svc.Store.GetDevicePublicKey(userId, deviceId)
+		if err != nil {
+			return err
+		}
+
+		if publicKey == nil {
+			return fmt.Errorf("%w: device (%s) was removed", ErrInvalidToken, deviceId)
+		}
+	}
+
+	return nil
+}
+
+// RefreshTokens exchanges a refresh token for a new token pair. Refresh tokens are single use,
+// the presented token is revoked, and a token that was already used is rejected.
+func (svc *UserService) RefreshTokens(refreshToken string) (string, *TokenPair, error) {
+	claims, err := svc.ValidateToken(refreshToken, RefreshToken)
+	if err != nil {
+		return "", nil, err
+	}
+
+	revoked, err := svc.RevokeToken(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !revoked {
+		return "", nil, fmt.Errorf("%w: refresh token was already used", ErrInvalidToken)
+	}
+
+	userId := claims["user_id"].(string)
+
+	pair, err := svc.IssueTokens(userId, ClaimsDeviceId(claims))
+	if err != nil {
+		return "", nil, err
+	}
+
+	return userId, pair, nil
+}
+
+// RevokeToken adds a validated token to the revocation list until it expires,
+// it returns false if the token was already revoked.
+func (svc *UserService) RevokeToken(claims jwt.MapClaims) (bool, error) {
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil {
+		return false, fmt.Errorf("%w: missing expiration claim", ErrInvalidToken)
+	}
+
+	return svc.Store.RevokeToken(claims["jti"].(string), expiresAt.Unix())
+}
+
+// RevokeAllTokens revokes every token issued to userId up until now.
+// Token timestamps have a one millisecond resolution, so tokens issued later during the current millisecond are revoked too.
+func (svc *UserService) RevokeAllTokens(userId string) error {
+	return svc.Store.RevokeUserTokens(userId, time.Now().UnixMilli()+1)
+}
+
+// dsaPublicKeys returns the server keys whose ML-DSA-87 tokens are accepted at now, the current key first.
+func (svc *UserService) dsaPublicKeys(now int64) []*mldsa87.PublicKey {
+	publicKeys := []*mldsa87.PublicKey{svc.dsaPublicKey}
+	for _, previous := range svc.previousDSAKeys {
+		if previous.retiresAt > now {
+			publicKeys = append(publicKeys, previous.publicKey)
+		}
+	}
+	return publicKeys
+}
@@ -0,0 +1,178 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader serves a TLS certificate and client CA bundle from disk, and swaps them in place when
+// the files change, so new handshakes use the new files while existing connections are kept.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	minVersion   uint16
+
+	current atomic.Pointer[loadedFiles]
+}
+
+type loadedFiles struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  []time.Time
+}
+
+// New loads the certificate, key and optional client CA bundle, minVersion is "1.2" or "1.3".
+func New(certFile string, keyFile string, clientCAFile string, minVersion string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+
+	switch minVersion {
+	case "", "1.2":
+		r.minVersion = tls.VersionTLS12
+	case "1.3":
+		r.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("Invalid TLS minimum version: %s", minVersion)
+	}
+
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// Reload reads the files again, on failure the previously loaded files stay in use.
+func (r *Reloader) Reload() error {
+	modTimes, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in client CA file (%s)", r.clientCAFile)
+		}
+	}
+
+	r.current.Store(&loadedFiles{cert: &cert, clientCAs: clientCAs, modTimes: modTimes})
+	return nil
+}
+
+func (r *Reloader) modTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// changed reports whether any file was modified since it was loaded.
+func (r *Reloader) changed() bool {
+	modTimes, err := r.modTimes()
+	if err != nil {
+		// Likely in the middle of being replaced, check again next time.
+		return false
+	}
+
+	loaded := r.current.Load().modTimes
+	for i := range modTimes {
+		if !modTimes[i].Equal(loaded[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the files whenever they change on disk, until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !r.changed() {
+			continue
+		}
+
+		if err := r.Reload(); err != nil {
+			slog.Error("Error while reloading TLS certificate, keeping the previous one", "error", err)
+			continue
+		}
+
+		slog.Info("Reloaded TLS certificate", "certFile", r.certFile)
+	}
+}
+
+// ServerConfig returns the TLS config to serve with. Clients may present a certificate,
+// which is verified against the client CA bundle when one is configured.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			loaded := r.current.Load()
+
+			cfg := &tls.Config{
+				MinVersion:   r.minVersion,
+				Certificates: []tls.Certificate{*loaded.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+
+			if loaded.clientCAs != nil {
+				cfg.ClientCAs = loaded.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns a TLS config presenting our certificate to servers asking for a client certificate.
+func (r *Reloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			loaded := r.current.Load()
+			if loaded == nil {
+				return nil, errors.New("No TLS certificate loaded")
+			}
+			return loaded.cert, nil
+		},
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
 )
 
 type redisConfig struct {
@@ -27,17 +28,95 @@ type sqlConfig struct {
 	DBPassword string `json:"db_password"`
 }
 
+type postgresConfig struct {
+	Host       string
+	Port       uint16
+	DBName     string `json:"db_name"`
+	DBUser     string `json:"db_user"`
+	DBPassword string `json:"db_password"`
+	SSLMode    string `json:"ssl_mode"`
+}
+
+type federationQueueConfig struct {
+	MaxAgeHours           uint32 `json:"Max_age_hours"`
+	InitialBackoffSeconds uint32 `json:"Initial_backoff_seconds"`
+	MaxBackoffSeconds     uint32 `json:"Max_backoff_seconds"`
+}
+
+type federationClientConfig struct {
+	ConnectTimeoutSeconds  uint32 `json:"Connect_timeout_seconds"`
+	ResponseTimeoutSeconds uint32 `json:"Response_timeout_seconds"`
+	MaxResponseBytes       uint64 `json:"Max_response_bytes"`
+	// Forbids falling back to plain HTTP, except for the servers in PlaintextPeers.
+	HTTPSOnly      bool     `json:"Https_only"`
+	PlaintextPeers []string `json:"Plaintext_peers"`
+	// PEM bundle of CAs trusted in addition to the system's, for private federations.
+	CAFile string `json:"CA_file"`
+}
+
+type mailboxQuotaConfig struct {
+	MaxBytes    uint64 `json:"Max_bytes"`
+	MaxMessages uint64 `json:"Max_messages"`
+}
+
+type tokenLifetimesConfig struct {
+	AccessSeconds  uint32 `json:"Access_token_seconds"`
+	RefreshSeconds uint32 `json:"Refresh_token_seconds"`
+}
+
+type tlsConfig struct {
+	Enabled    bool   `json:"Enabled"`
+	CertFile   string `json:"Cert_file"`
+	KeyFile    string `json:"Key_file"`
+	MinVersion string `json:"Min_version"`
+	// CA bundle verifying client certificates presented by federated servers, optional.
+	ClientCAFile string `json:"Client_CA_file"`
+	// Rejects /federation/send requests without a verified client certificate.
+	RequireFederationClientCert bool `json:"Require_federation_client_cert"`
+}
+
+type devicesConfig struct {
+	// Devices per user, including the one the user registered with.
+	MaxDevices uint32 `json:"Max_devices"`
+	// "all" deletes a blob once every device acknowledged it, "any" once the first one did.
+	AckPolicy string `json:"Ack_policy"`
+}
+
+type metricsConfig struct {
+	Enabled bool `json:"Enabled"`
+	// Serves /metrics on this host:port instead of the main listener, optional.
+	ListenAddress string `json:"Listen_address"`
+}
+
 type Config struct {
-	DomainOrIP         string      `json:"Your_domain_or_IP"`
-	FederationEnabled  bool        `json:"Federation_enabled"`
-	UserStorage        string      `json:"User_storage"`
-	DataStorage        string      `json:"Data_storage"`
-	Redis              redisConfig `json:"Redis"`
-	SQL                sqlConfig   `json:"SQL"`
-	BlacklistedDomains []string    `json:"Blacklisted_Domain_Names"`
-	BlacklistedIPs     []string    `json:"Blacklisted_IP_nets"`
-	JWTSecret          []byte      `json:"JWT_Secret_Base64_Encoded"`
-	DSAPrivateKey      []byte      `json:"ML_DSA_87_Private_Key_Base64_Encoded"`
+	DomainOrIP         string                  `json:"Your_domain_or_IP"`
+	FederationEnabled  bool                    `json:"Federation_enabled"`
+	FederationQueue    federationQueueConfig   `json:"Federation_queue"`
+	FederationReplay   uint32                  `json:"Federation_replay_window_seconds"`
+	FederationLegacy   string                  `json:"Federation_legacy_until"`
+	FederationClient   federationClientConfig  `json:"Federation_client"`
+	MaxDataRetention   uint32                  `json:"Max_data_retention_hours"`
+	MailboxQuota       mailboxQuotaConfig      `json:"Mailbox_quota"`
+	ChallengeTTL       uint32                  `json:"Challenge_ttl_seconds"`
+	UserIdCooldown     uint32                  `json:"User_id_reuse_cooldown_hours"`
+	Devices            devicesConfig           `json:"Devices"`
+	TokenLifetimes     tokenLifetimesConfig    `json:"Token_lifetimes"`
+	TokenMode          string                  `json:"Token_mode"`
+	UserStorage        string                  `json:"User_storage"`
+	DataStorage        string                  `json:"Data_storage"`
+	NotificationFanout string                  `json:"Notification_fanout"`
+	Redis              redisConfig             `json:"Redis"`
+	SQL                sqlConfig               `json:"SQL"`
+	Postgres           postgresConfig          `json:"Postgres"`
+	TLS                tlsConfig               `json:"TLS"`
+	Metrics            metricsConfig           `json:"Metrics"`
+	BlacklistedDomains []string                `json:"Blacklisted_Domain_Names"`
+	BlacklistedIPs     []string                `json:"Blacklisted_IP_nets"`
+	JWTKeys            crypto.JWTKeyring       `json:"JWT_Keys"`
+	JWTSecret          []byte                  `json:"JWT_Secret_Base64_Encoded,omitempty"` // Deprecated: moved into JWT_Keys on load
+	DSAPrivateKey      []byte                  `json:"ML_DSA_87_Private_Key_Base64_Encoded"`
+	DSAPreviousKeys    []crypto.PreviousDSAKey `json:"ML_DSA_87_Previous_Keys,omitempty"`
+	DSAKeyRetirement   uint32                  `json:"ML_DSA_87_Key_Retirement_Hours"`
 }
 
 func Load(path string) (*Config, error) {
@@ -56,6 +135,65 @@ func Load(path string) (*Config, error) {
 	cfg.DomainOrIP = strings.ToLower(cfg.DomainOrIP)
 	cfg.UserStorage = strings.ToLower(cfg.UserStorage)
 	cfg.DataStorage = strings.ToLower(cfg.DataStorage)
+	cfg.NotificationFanout = strings.ToLower(cfg.NotificationFanout)
+	cfg.TokenMode = strings.ToLower(cfg.TokenMode)
+	cfg.Devices.AckPolicy = strings.ToLower(cfg.Devices.AckPolicy)
+
+	if cfg.FederationQueue.MaxAgeHours == 0 {
+		cfg.FederationQueue.MaxAgeHours = constants.FEDERATION_QUEUE_MAX_AGE_HOURS
+	}
+
+	if cfg.FederationQueue.InitialBackoffSeconds == 0 {
+		cfg.FederationQueue.InitialBackoffSeconds = constants.FEDERATION_QUEUE_INITIAL_BACKOFF
+	}
+
+	if cfg.FederationQueue.MaxBackoffSeconds == 0 {
+		cfg.FederationQueue.MaxBackoffSeconds = constants.FEDERATION_QUEUE_MAX_BACKOFF
+	}
+
+	if cfg.FederationClient.ConnectTimeoutSeconds == 0 {
+		cfg.FederationClient.ConnectTimeoutSeconds = constants.FEDERATION_CONNECT_TIMEOUT
+	}
+
+	if cfg.FederationClient.ResponseTimeoutSeconds == 0 {
+		cfg.FederationClient.ResponseTimeoutSeconds = constants.FEDERATION_RESPONSE_TIMEOUT
+	}
+
+	if cfg.FederationClient.MaxResponseBytes == 0 {
+		cfg.FederationClient.MaxResponseBytes = constants.FEDERATION_MAX_RESPONSE_BYTES
+	}
+
+	if cfg.FederationReplay == 0 {
+		cfg.FederationReplay = constants.FEDERATION_REPLAY_WINDOW
+	}
+
+	if cfg.DSAKeyRetirement == 0 {
+		cfg.DSAKeyRetirement = constants.DSA_KEY_RETIREMENT_HOURS
+	}
+
+	if cfg.ChallengeTTL == 0 {
+		cfg.ChallengeTTL = constants.CHALLENGE_TTL
+	}
+
+	if cfg.UserIdCooldown == 0 {
+		cfg.UserIdCooldown = constants.USER_ID_REUSE_COOLDOWN_HOURS
+	}
+
+	if cfg.Devices.MaxDevices == 0 {
+		cfg.Devices.MaxDevices = constants.MAX_DEVICES
+	}
+
+	if cfg.Devices.AckPolicy == "" {
+		cfg.Devices.AckPolicy = "all"
+	}
+
+	if cfg.TokenLifetimes.AccessSeconds == 0 {
+		cfg.TokenLifetimes.AccessSeconds = constants.ACCESS_TOKEN_LIFETIME
+	}
+
+	if cfg.TokenLifetimes.RefreshSeconds == 0 {
+		cfg.TokenLifetimes.RefreshSeconds = constants.REFRESH_TOKEN_LIFETIME
+	}
 
 	// Sanity check the configuration
 	err = cfg.Validate()
@@ -63,15 +201,29 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
-	if cfg.JWTSecret == nil || len(cfg.JWTSecret) == 0 {
-		cfg.JWTSecret, err = utils.SecureRandomBytes(constants.JWT_SECRET_LEN)
+	if len(cfg.JWTKeys) == 0 {
+		key, err := crypto.NewJWTKey()
 		if err != nil {
 			return nil, err
 		}
 
+		// Keep the secret of configs written before JWT_Keys existed.
+		if len(cfg.JWTSecret) != 0 {
+			key.Secret = cfg.JWTSecret
+			cfg.JWTSecret = nil
+		}
+
+		cfg.JWTKeys = crypto.JWTKeyring{key}
 		cfg.Write(path)
 	}
 
+	// ML-DSA-87 tokens don't need the keyring, which may be fully retired to stop accepting HMAC tokens.
+	if cfg.TokenMode != "ml-dsa-87" {
+		if _, err := cfg.JWTKeys.Active(); err != nil {
+			return nil, err
+		}
+	}
+
 	if cfg.DSAPrivateKey == nil || len(cfg.DSAPrivateKey) == 0 {
 		_, privateKey, err := crypto.CreateDSAKeyPair()
 		if err != nil {
@@ -99,15 +251,58 @@ func (c *Config) Write(path string) error {
 
 func (c *Config) Validate() error {
 	switch c.UserStorage {
-	case "sql", "internal":
+	case "sql", "internal", "postgres", "redis":
 	default:
 		return fmt.Errorf("Invalid user storage mechanism: %s", c.UserStorage)
 	}
 
 	switch c.DataStorage {
-	case "internal", "redis", "sql":
+	case "internal", "redis", "sql", "postgres":
 	default:
-		return fmt.Errorf("Invalid data storage:  %s", c.UserStorage)
+		return fmt.Errorf("Invalid data storage:  %s", c.DataStorage)
+	}
+
+	// Postgres and SQL fan-out piggyback on the data table, so they only work when it lives there.
+	switch c.NotificationFanout {
+	case "", "none", "redis":
+	case "postgres", "sql":
+		if c.NotificationFanout != c.DataStorage {
+			return fmt.Errorf("Notification fan-out (%s) requires Data storage to be %s", c.NotificationFanout, c.NotificationFanout)
+		}
+	default:
+		return fmt.Errorf("Invalid notification fan-out: %s", c.NotificationFanout)
+	}
+
+	if c.FederationQueue.InitialBackoffSeconds > c.FederationQueue.MaxBackoffSeconds {
+		return fmt.Errorf("Federation queue initial backoff (%d) is larger than max backoff (%d)", c.FederationQueue.InitialBackoffSeconds, c.FederationQueue.MaxBackoffSeconds)
+	}
+
+	if c.FederationLegacy != "" {
+		if _, err := time.Parse("2006-01-02", c.FederationLegacy); err != nil {
+			return fmt.Errorf("Invalid Federation_legacy_until date: %w", err)
+		}
+	}
+
+	for _, cidr := range c.BlacklistedIPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("Invalid Blacklisted_IP_nets entry: %w", err)
+		}
+	}
+
+	switch c.TokenMode {
+	case "", "hmac", "ml-dsa-87":
+	default:
+		return fmt.Errorf("Invalid token mode: %s", c.TokenMode)
+	}
+
+	switch c.Devices.AckPolicy {
+	case "", "all", "any":
+	default:
+		return fmt.Errorf("Invalid Devices Ack_policy: %s", c.Devices.AckPolicy)
+	}
+
+	if c.TokenLifetimes.AccessSeconds > c.TokenLifetimes.RefreshSeconds {
+		return fmt.Errorf("Access token lifetime (%d) is longer than refresh token lifetime (%d)", c.TokenLifetimes.AccessSeconds, c.TokenLifetimes.RefreshSeconds)
 	}
 
 	if c.Redis.Port == 0 {
@@ -118,6 +313,40 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("Invalid SQL port: %d", c.SQL.Port)
 	}
 
+	if c.UserStorage == "postgres" || c.DataStorage == "postgres" {
+		if c.Postgres.Port == 0 {
+			return fmt.Errorf("Invalid Postgres port: %d", c.Postgres.Port)
+		}
+
+		switch c.Postgres.SSLMode {
+		case "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			return fmt.Errorf("Invalid Postgres ssl_mode: %s", c.Postgres.SSLMode)
+		}
+	}
+
+	if c.TLS.Enabled {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return errors.New("TLS requires both Cert_file and Key_file")
+		}
+
+		switch c.TLS.MinVersion {
+		case "", "1.2", "1.3":
+		default:
+			return fmt.Errorf("Invalid TLS Min_version: %s", c.TLS.MinVersion)
+		}
+
+		if c.TLS.RequireFederationClientCert && c.TLS.ClientCAFile == "" {
+			return errors.New("TLS Require_federation_client_cert requires a Client_CA_file")
+		}
+	}
+
+	if c.Metrics.Enabled && c.Metrics.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Metrics.ListenAddress); err != nil {
+			return fmt.Errorf("Invalid Metrics Listen_address: %w", err)
+		}
+	}
+
 	if len(c.DomainOrIP) == 0 {
 		return errors.New("You must include your domain name or IP address in the configuration file.")
 	}
@@ -11,11 +11,59 @@ const (
 	ML_DSA_87_SIGN_LEN = 4627
 
 	CHALLENGE_LEN = 64
+	CHALLENGE_TTL = 300
+
+	USER_JANITOR_INTERVAL = 60
+
+	USER_ID_REUSE_COOLDOWN_HOURS = 720
+
+	PRIMARY_DEVICE_ID = "primary"
+	DEVICE_ID_LEN     = 8
+	MAX_DEVICES       = 10
 
 	JWT_SECRET_LEN = 256
+	JWT_KEY_ID_LEN = 8
+	JWT_ID_LEN     = 16
+
+	ACCESS_TOKEN_LIFETIME  = 3600
+	REFRESH_TOKEN_LIFETIME = 2592000
 
 	LONGPOLL_MAX = 30
 
+	SHUTDOWN_TIMEOUT = 15
+
+	HEALTH_CHECK_TIMEOUT = 5
+
+	TLS_RELOAD_CHECK_INTERVAL = 10
+
+	WEBSOCKET_PING_INTERVAL     = 30
+	WEBSOCKET_PONG_WAIT         = 60
+	WEBSOCKET_WRITE_WAIT        = 10
+	WEBSOCKET_MAX_MESSAGE_BYTES = 1 << 18
+
+	SSE_KEEPALIVE_INTERVAL = 15
+
+	ACK_ID_LEN = 32
+
+	FEDERATION_QUEUE_MAX_AGE_HOURS   = 72
+	FEDERATION_QUEUE_INITIAL_BACKOFF = 30
+	FEDERATION_QUEUE_MAX_BACKOFF     = 3600
+	FEDERATION_QUEUE_INTERVAL        = 5
+	FEDERATION_QUEUE_BATCH           = 100
+
+	FEDERATION_REPLAY_WINDOW  = 300
+	FEDERATION_MESSAGE_ID_LEN = 16
+
+	FEDERATION_KEY_REFETCH_COOLDOWN = 60
+
+	DSA_KEY_RETIREMENT_HOURS = 720
+
+	FEDERATION_CONNECT_TIMEOUT    = 10
+	FEDERATION_RESPONSE_TIMEOUT   = 30
+	FEDERATION_MAX_RESPONSE_BYTES = 1 << 20
+
+	DATA_JANITOR_INTERVAL = 60
+
 	COLDWIRE_DATA_SEP   byte = 0
 	COLDWIRE_LEN_OFFSET      = 3
 
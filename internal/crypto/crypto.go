@@ -2,33 +2,62 @@ package crypto
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func CreateJWTToken(claims map[string]interface{}, JWTSecret []byte) (string, error) {
-	tokenClaims := jwt.MapClaims{}
-	for k, v := range claims {
-		tokenClaims[k] = v
-	}
+// CreateJWTToken signs the claims with an HMAC key of the JWT keyring.
+func CreateJWTToken(claims map[string]interface{}, key *JWTKey) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims(claims))
+	token.Header["kid"] = key.Id
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS512, tokenClaims)
-	tokenString, err := token.SignedString(JWTSecret)
-	if err != nil {
-		return "", err
-	}
+	return token.SignedString(key.Secret)
+}
+
+// CreateMLDSAToken signs the claims with the server's ML-DSA-87 key, anyone holding
+// the public key served at /federation/info can verify the token.
+func CreateMLDSAToken(claims map[string]interface{}, privateKey *mldsa87.PrivateKey) (string, error) {
+	token := jwt.NewWithClaims(SigningMethodMLDSA, jwt.MapClaims(claims))
 
-	return tokenString, nil
+	return token.SignedString(privateKey)
 }
 
-func VerifyJWT(tokenString string, JWTSecret []byte) (*jwt.Token, jwt.MapClaims, error) {
+// VerifyJWT accepts HMAC tokens signed by any key of the keyring that is not retired yet,
+// and ML-DSA-87 tokens signed by a server key matching any of publicKeys.
+func VerifyJWT(tokenString string, keyring JWTKeyring, publicKeys ...*mldsa87.PublicKey) (*jwt.Token, jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		switch token.Method.(type) {
+		case *SigningMethodMLDSA87:
+			var keys jwt.VerificationKeySet
+			for _, publicKey := range publicKeys {
+				if publicKey != nil {
+					keys.Keys = append(keys.Keys, publicKey)
+				}
+			}
+
+			if len(keys.Keys) == 0 {
+				return nil, fmt.Errorf("no public key to verify %v tokens", token.Header["alg"])
+			}
+			return keys, nil
+
+		case *jwt.SigningMethodHMAC:
+			kid, ok := token.Header["kid"].(string)
+			if !ok {
+				return nil, fmt.Errorf("missing kid header")
+			}
+
+			key, err := keyring.Lookup(kid, time.Now().Unix())
+			if err != nil {
+				return nil, err
+			}
+			return key.Secret, nil
+
+		default:
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return JWTSecret, nil
-	})
+	}, jwt.WithExpirationRequired(), jwt.WithIssuedAt())
 
 	if err != nil {
 		return nil, nil, err
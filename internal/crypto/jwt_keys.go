@@ -0,0 +1,80 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+)
+
+// JWTKey is an HMAC secret, identified by the "kid" header of the tokens it signs.
+type JWTKey struct {
+	Id        string `json:"Id"`
+	Secret    []byte `json:"Secret_Base64_Encoded"`
+	CreatedAt int64  `json:"Created_at"`
+	// Unix time after which tokens signed by this key are rejected, 0 means the key is not retired.
+	RetiresAt int64 `json:"Retires_at"`
+}
+
+// JWTKeyring holds every JWT key still accepted by the server, the newest non-retired key signs new tokens.
+type JWTKeyring []JWTKey
+
+func NewJWTKey() (JWTKey, error) {
+	id, err := utils.SecureRandomBytes(constants.JWT_KEY_ID_LEN)
+	if err != nil {
+		return JWTKey{}, err
+	}
+
+	secret, err := utils.SecureRandomBytes(constants.JWT_SECRET_LEN)
+	if err != nil {
+		return JWTKey{}, err
+	}
+
+	return JWTKey{Id: hex.EncodeToString(id), Secret: secret, CreatedAt: time.Now().Unix()}, nil
+}
+
+// Retired reports whether tokens signed by the key are no longer accepted at now.
+func (k *JWTKey) Retired(now int64) bool {
+	return k.RetiresAt != 0 && k.RetiresAt <= now
+}
+
+// Active returns the key used to sign new tokens, the newest key that isn't being retired,
+// keys created during the same second are ordered by their position in the keyring.
+func (k JWTKeyring) Active() (*JWTKey, error) {
+	var active *JWTKey
+	for i := range k {
+		if k[i].RetiresAt != 0 {
+			continue
+		}
+
+		if active == nil || k[i].CreatedAt >= active.CreatedAt {
+			active = &k[i]
+		}
+	}
+
+	if active == nil {
+		return nil, errors.New("No active JWT key, add one with the jwt-keys add command")
+	}
+
+	return active, nil
+}
+
+// Lookup returns the key with the given ID, as long as it is not retired at now.
+func (k JWTKeyring) Lookup(id string, now int64) (*JWTKey, error) {
+	for i := range k {
+		if k[i].Id != id {
+			continue
+		}
+
+		if k[i].Retired(now) {
+			return nil, fmt.Errorf("JWT key (%s) is retired", id)
+		}
+
+		return &k[i], nil
+	}
+
+	return nil, fmt.Errorf("Unknown JWT key (%s)", id)
+}
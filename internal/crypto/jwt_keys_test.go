@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJWTKeyringRotation(t *testing.T) {
+	oldKey, err := NewJWTKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := NewJWTKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring := JWTKeyring{oldKey}
+	now := time.Now().Unix()
+
+	claims := map[string]interface{}{"user_id": "1234567890123456", "iat": now, "exp": now + 60}
+
+	oldToken, err := CreateJWTToken(claims, &keyring[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring = append(keyring, newKey)
+
+	active, err := keyring.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active.Id != newKey.Id {
+		t.Fatalf("expected the newest key (%s) to be active, got %s", newKey.Id, active.Id)
+	}
+
+	if _, _, err := VerifyJWT(oldToken, keyring, nil); err != nil {
+		t.Fatalf("token signed by a key in its grace period was rejected: %v", err)
+	}
+
+	keyring[0].RetiresAt = now
+	if _, _, err := VerifyJWT(oldToken, keyring, nil); err == nil {
+		t.Fatal("token signed by a retired key was accepted")
+	}
+
+	if _, _, err := VerifyJWT(oldToken, JWTKeyring{newKey}, nil); err == nil {
+		t.Fatal("token signed by an unknown key was accepted")
+	}
+}
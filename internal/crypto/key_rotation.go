@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
+)
+
+// PreviousDSAKey is an identity key the server rotated away from, kept until RetiresAt to sign its rotation to
+// ReplacedBy, so that peers which pinned it can follow the server to its new key.
+type PreviousDSAKey struct {
+	PrivateKey []byte `json:"Private_Key_Base64_Encoded"`
+	ReplacedBy []byte `json:"Replaced_By_Public_Key_Base64_Encoded"`
+	ReplacedAt int64  `json:"Replaced_at"`
+	RetiresAt  int64  `json:"Retires_at"`
+}
+
+// Retired reports whether the key no longer signs its rotation, nor verifies tokens, at now.
+func (k *PreviousDSAKey) Retired(now int64) bool {
+	return k.RetiresAt <= now
+}
+
+// keyRotationContext keeps key-rotation signatures apart from everything else the server signs with the same key.
+var keyRotationContext = []byte("coldwire-federation-key-rotation")
+
+func keyRotationSignedData(url string, previousPublicKey []byte, publicKey []byte) []byte {
+	signed := append([]byte(url), previousPublicKey...)
+	return append(signed, publicKey...)
+}
+
+// SignKeyRotation signs, with the previous private key, that the server at url replaced previousPublicKey by publicKey.
+func SignKeyRotation(previousPrivateKey *mldsa87.PrivateKey, url string, previousPublicKey []byte, publicKey []byte) ([]byte, error) {
+	return CreateSignature(previousPrivateKey, keyRotationSignedData(url, previousPublicKey, publicKey), keyRotationContext)
+}
+
+// VerifyKeyRotation checks that previousPublicKey signed its replacement by publicKey for the server at url.
+func VerifyKeyRotation(url string, previousPublicKey []byte, publicKey []byte, signature []byte) bool {
+	previous, err := PublicKeyFromBytes(previousPublicKey)
+	if err != nil {
+		return false
+	}
+
+	return VerifySignature(previous, keyRotationSignedData(url, previousPublicKey, publicKey), keyRotationContext, signature)
+}
@@ -0,0 +1,47 @@
+package crypto
+
+import (
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenSignatureContext is the ML-DSA context string of token signatures. It keeps them apart from the
+// federation signatures made with the same server key, so one can never be passed off as the other.
+const TokenSignatureContext = "coldwire-token"
+
+// SigningMethodMLDSA87 signs JWTs with the server's ML-DSA-87 key, under the "ML-DSA-87" alg.
+type SigningMethodMLDSA87 struct{}
+
+var SigningMethodMLDSA = &SigningMethodMLDSA87{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodMLDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodMLDSA
+	})
+}
+
+func (m *SigningMethodMLDSA87) Alg() string {
+	return "ML-DSA-87"
+}
+
+func (m *SigningMethodMLDSA87) Sign(signingString string, key any) ([]byte, error) {
+	privateKey, ok := key.(*mldsa87.PrivateKey)
+	if !ok {
+		return nil, jwt.ErrInvalidKeyType
+	}
+
+	return CreateSignature(privateKey, []byte(signingString), []byte(TokenSignatureContext))
+}
+
+func (m *SigningMethodMLDSA87) Verify(signingString string, sig []byte, key any) error {
+	publicKey, ok := key.(*mldsa87.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	if !VerifySignature(publicKey, []byte(signingString), []byte(TokenSignatureContext), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
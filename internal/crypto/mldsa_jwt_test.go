@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMLDSAToken(t *testing.T) {
+	publicKey, privateKey, err := CreateDSAKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherPublicKey, _, err := CreateDSAKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	token, err := CreateMLDSAToken(map[string]interface{}{"user_id": "1234567890123456", "iat": now, "exp": now + 60}, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, claims, err := VerifyJWT(token, nil, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims["user_id"] != "1234567890123456" {
+		t.Fatalf("unexpected claims: %v", claims)
+	}
+
+	if _, _, err := VerifyJWT(token, nil, otherPublicKey); err == nil {
+		t.Fatal("token was accepted with another server's public key")
+	}
+
+	// Tokens signed before a key rotation stay valid while the previous key is still accepted.
+	if _, _, err := VerifyJWT(token, nil, otherPublicKey, publicKey); err != nil {
+		t.Fatalf("token was rejected with its key among the accepted ones: %v", err)
+	}
+
+	// Flip the end of the signature.
+	if _, _, err := VerifyJWT(token[:len(token)-4]+"AAAA", nil, publicKey); err == nil {
+		t.Fatal("tampered token was accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+)
+
+// ErrBlockedAddress is returned when a federated server resolves to an address in Blacklisted_IP_nets.
+var ErrBlockedAddress = errors.New("Address is blacklisted")
+
+// NewFederationClient returns the HTTP client used to reach federated servers, presenting tlsConfig's client
+// certificate if any, and trusting the CAs of the federation CA_file if set. Every address it connects to is
+// checked against Blacklisted_IP_nets once resolved, so a domain pointing at an internal address is refused
+// just like the address itself.
+// Redirects are not followed, proxies are not used, and responses are bounded in time and size.
+func NewFederationClient(cfg *config.Config, tlsConfig *tls.Config) (*http.Client, error) {
+	blacklist, err := parseIPNets(cfg.BlacklistedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.FederationClient.CAFile != "" {
+		tlsConfig, err = withRootCAs(tlsConfig, cfg.FederationClient.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	connectTimeout := time.Second * time.Duration(cfg.FederationClient.ConnectTimeoutSeconds)
+	responseTimeout := time.Second * time.Duration(cfg.FederationClient.ResponseTimeoutSeconds)
+
+	dialer := &net.Dialer{
+		Timeout: connectTimeout,
+		// Called with the resolved address of every connection attempt, so DNS can't be changed in between.
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("%w: %s is not an IP address", ErrBlockedAddress, host)
+			}
+
+			for _, network := range blacklist {
+				if network.Contains(ip) {
+					return fmt.Errorf("%w: %s is in %s", ErrBlockedAddress, ip, network)
+				}
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: responseTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &limitedTransport{base: transport, maxBytes: int64(cfg.FederationClient.MaxResponseBytes)},
+		Timeout:   responseTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// withRootCAs returns a copy of tlsConfig trusting the CAs in caFile along with the system's.
+func withRootCAs(tlsConfig *tls.Config, caFile string) (*tls.Config, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in federation CA file (%s)", caFile)
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	tlsConfig.RootCAs = roots
+
+	return tlsConfig, nil
+}
+
+func parseIPNets(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// limitedTransport fails reading response bodies larger than maxBytes with an *http.MaxBytesError.
+type limitedTransport struct {
+	base     http.RoundTripper
+	maxBytes int64
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = http.MaxBytesReader(nil, resp.Body, t.maxBytes)
+	return resp, nil
+}
+
+// allowPlaintext reports whether the federated server url may be reached over plain HTTP when HTTPS fails.
+func (svc *DataService) allowPlaintext(url string) bool {
+	return !svc.Cfg.FederationClient.HTTPSOnly || slices.ContainsFunc(svc.Cfg.FederationClient.PlaintextPeers, func(peer string) bool {
+		return strings.EqualFold(peer, url)
+	})
+}
@@ -0,0 +1,152 @@
+package data
+
+import (
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+)
+
+func testFederationClient(t *testing.T, blacklistedIPs []string) *http.Client {
+	cfg := &config.Config{BlacklistedIPs: blacklistedIPs}
+	cfg.FederationClient.ConnectTimeoutSeconds = 5
+	cfg.FederationClient.ResponseTimeoutSeconds = 5
+	cfg.FederationClient.MaxResponseBytes = 16
+
+	client, err := NewFederationClient(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestFederationClientBlocksResolvedAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	// Resolved by the client, so the blacklist must apply to the address "localhost" resolves to.
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	_, err := testFederationClient(t, []string{"127.0.0.0/8", "::1/128"}).Get(url)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Fatalf("expected ErrBlockedAddress, got %v", err)
+	}
+
+	resp, err := testFederationClient(t, []string{"10.0.0.0/8"}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestFederationClientDoesNotFollowRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://10.0.0.1/federation/info", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	resp, err := testFederationClient(t, nil).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("expected the redirect itself, got status %d", resp.StatusCode)
+	}
+}
+
+func TestFederationClientCapsResponseSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("a", 17)))
+	}))
+	defer srv.Close()
+
+	resp, err := testFederationClient(t, nil).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var maxBytesErr *http.MaxBytesError
+	if _, err := io.ReadAll(resp.Body); !errors.As(err, &maxBytesErr) {
+		t.Fatalf("expected *http.MaxBytesError, got %v", err)
+	}
+}
+
+func TestFederationClientTrustsCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	if _, err := testFederationClient(t, nil).Get(srv.URL); err == nil {
+		t.Fatal("server certificate trusted without its CA")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	cfg.FederationClient.ConnectTimeoutSeconds = 5
+	cfg.FederationClient.ResponseTimeoutSeconds = 5
+	cfg.FederationClient.MaxResponseBytes = 16
+	cfg.FederationClient.CAFile = caFile
+
+	client, err := NewFederationClient(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTPSOnlyFallback(t *testing.T) {
+	var plaintextRequests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plaintextRequests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	// Only reachable over plain HTTP, so the HTTPS attempt always fails.
+	url := srv.Listener.Addr().String()
+
+	cfg := &config.Config{}
+	cfg.FederationClient.HTTPSOnly = true
+	svc := &DataService{Cfg: cfg, FederationClient: testFederationClient(t, nil)}
+
+	if _, _, err := svc.FetchAndSaveServerInfo(url); err == nil {
+		t.Fatal("server info fetched from a plaintext-only server")
+	}
+	if plaintextRequests.Load() != 0 {
+		t.Fatal("fell back to plain HTTP with Https_only set")
+	}
+
+	cfg.FederationClient.PlaintextPeers = []string{strings.ToUpper(url)}
+
+	var remoteErr *RemoteError
+	if _, _, err := svc.FetchAndSaveServerInfo(url); !errors.As(err, &remoteErr) || remoteErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected the plaintext peer's 404, got %v", err)
+	}
+	if plaintextRequests.Load() != 1 {
+		t.Fatalf("expected 1 plain HTTP request to the plaintext peer, got %d", plaintextRequests.Load())
+	}
+}
@@ -2,83 +2,321 @@ package data
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/metrics"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/notify"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/mysql"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/backends"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/redis"
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/sqlite"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
 	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
 )
 
+// ErrMailboxFull is returned when the recipient has too much undelivered data queued.
+var ErrMailboxFull = storage.ErrMailboxFull
+
+// ErrServerKeyChanged is returned when a federated server presents another key than the one we pinned,
+// without a chain of key rotations signed by the pinned key leading to it.
+var ErrServerKeyChanged = errors.New("Federated server key changed")
+
+// ErrFederationReplay is returned when a federated server sends a message ID it already sent us.
+var ErrFederationReplay = errors.New("Federation message was already received")
+
+// ErrLegacyFederation is returned when a federated server running an older version sends a message without a signed
+// timestamp nor message ID, past the Federation_legacy_until date.
+var ErrLegacyFederation = errors.New("Federation message has no timestamp nor message ID")
+
+// ErrFederationUnavailable is returned when a federation message could not be processed because of a failure on our
+// side, such as storage or fetching the sender's key, rather than a fault of the message. The sender should retry it.
+var ErrFederationUnavailable = errors.New("Federation message could not be processed")
+
 type DataService struct {
 	Store     storage.DataStorage
 	Cfg       *config.Config
 	UserStore storage.UserStorage
+	Hub       *notify.Hub
+	Fanout    storage.Notifier
+
+	// Delivers federation messages, presents our TLS certificate when TLS is enabled.
+	FederationClient *http.Client
+
+	// Set when Fanout was opened just for notifications, and must be closed along with Store.
+	ownsFanout bool
+
+	// Unix time of the last key refetch triggered by an invalid signature, per federated server.
+	keyRefetchMu sync.Mutex
+	keyRefetches map[string]int64
+
+	// Background workers run until ctx is canceled by Close.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+
+	// Outbound federation deliveries run until Close gives up on them, so in-flight ones can still finish.
+	deliveries       context.Context
+	cancelDeliveries context.CancelFunc
 }
 
-func NewDataService(cfg *config.Config, userStore storage.UserStorage) (*DataService, error) {
-	var s storage.DataStorage
-	switch cfg.DataStorage {
-	case "internal", "sqlite":
-		sqliteStore, err := sqlite.New(constants.SQLITE_DB_NAME)
-		if err != nil {
-			return nil, err
+// OpenStorage connects to the configured DataStorage backend.
+func OpenStorage(cfg *config.Config) (storage.DataStorage, error) {
+	return backends.Open(cfg.DataStorage, cfg)
+}
+
+// NewDataService opens the DataStorage and starts the background workers. tlsConfig holds the client certificate
+// presented to federated servers, if any.
+func NewDataService(cfg *config.Config, userStore storage.UserStorage, tlsConfig *tls.Config) (*DataService, error) {
+	s, err := OpenStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	federationClient, err := NewFederationClient(cfg, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries, cancelDeliveries := context.WithCancel(context.Background())
+	svc := &DataService{
+		Store:            s,
+		Cfg:              cfg,
+		UserStore:        userStore,
+		Hub:              notify.NewHub(),
+		FederationClient: federationClient,
+		keyRefetches:     make(map[string]int64),
+		ctx:              ctx,
+		cancel:           cancel,
+		deliveries:       deliveries,
+		cancelDeliveries: cancelDeliveries,
+	}
+
+	switch cfg.NotificationFanout {
+	case "redis":
+		if redisStore, ok := s.(*redis.RedisStorage); ok {
+			svc.Fanout = redisStore
+		} else {
+			portString := strconv.FormatUint(uint64(cfg.Redis.Port), 10)
+			redisStore, err := redis.New(cfg.Redis.Host, portString, cfg.Redis.Password, int(cfg.Redis.DB))
+			if err != nil {
+				return nil, err
+			}
+			svc.Fanout = redisStore
+			svc.ownsFanout = true
+		}
+
+	case "postgres", "sql":
+		notifier, ok := s.(storage.Notifier)
+		if !ok {
+			return nil, fmt.Errorf("DataStorage (%s) does not support notification fan-out", cfg.DataStorage)
 		}
-		s = sqliteStore
+		svc.Fanout = notifier
+	}
+
+	// Wrapped once the fan-out was picked, which needs the backend's concrete type.
+	svc.Store = metrics.NewDataStorage(cfg.DataStorage, s)
+
+	if svc.Fanout != nil {
+		svc.startWorker(svc.runFanout)
+	}
+
+	if cfg.FederationEnabled {
+		svc.startWorker(svc.runOutboundQueue)
+	}
+
+	svc.startWorker(svc.runDataJanitor)
+
+	return svc, nil
+}
+
+func (svc *DataService) startWorker(worker func()) {
+	svc.workers.Add(1)
+	go func() {
+		defer svc.workers.Done()
+		worker()
+	}()
+}
+
+// Close stops the background workers, and delivers the due outbound federation messages until ctx is done,
+// then closes the storage. Messages still queued are kept in storage and retried on the next start.
+func (svc *DataService) Close(ctx context.Context) error {
+	svc.cancel()
+
+	stopDeliveries := context.AfterFunc(ctx, svc.cancelDeliveries)
+	defer stopDeliveries()
+
+	done := make(chan struct{})
+	go func() {
+		svc.workers.Wait()
+		close(done)
+	}()
 
-	case "mysql", "sql", "mariadb":
-		sqlCfg := mysql.SQLDSN{
-			User:                 cfg.SQL.DBUser,
-			Passwd:               cfg.SQL.DBPassword,
-			Net:                  "tcp",
-			Addr:                 fmt.Sprintf("%s:%d", cfg.SQL.Host, cfg.SQL.Port),
-			DBName:               cfg.SQL.DBName,
-			ParseTime:            false,
-			AllowNativePasswords: true,
-			Collation:            "utf8mb4_unicode_ci",
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("Timed out while waiting for data workers to stop", "error", ctx.Err())
+	}
+
+	if svc.Cfg.FederationEnabled {
+		svc.drainOutboundQueue(ctx)
+	}
+
+	if closer, ok := svc.Fanout.(interface{ ExitCleanup() error }); ok && svc.ownsFanout {
+		if err := closer.ExitCleanup(); err != nil {
+			slog.Error("Error while closing notification fan-out", "error", err)
 		}
+	}
+
+	return svc.Store.ExitCleanup()
+}
+
+// mailboxQuota returns the quota every local mailbox is held to.
+func (svc *DataService) mailboxQuota() storage.MailboxQuota {
+	return storage.MailboxQuota{
+		MaxBytes:    int64(svc.Cfg.MailboxQuota.MaxBytes),
+		MaxMessages: int64(svc.Cfg.MailboxQuota.MaxMessages),
+	}
+}
+
+// dataExpiry returns when data sent with ttl seconds must be deleted, 0 meaning never.
+func (svc *DataService) dataExpiry(ttl int64) int64 {
+	now := time.Now().Unix()
+
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now + ttl
+	}
 
-		sqlStore, err := mysql.New(sqlCfg)
+	if svc.Cfg.MaxDataRetention > 0 {
+		maxExpiresAt := now + int64(svc.Cfg.MaxDataRetention)*3600
+		if expiresAt == 0 || expiresAt > maxExpiresAt {
+			expiresAt = maxExpiresAt
+		}
+	}
+
+	return expiresAt
+}
+
+// runDataJanitor periodically deletes expired data, and measures what is left.
+func (svc *DataService) runDataJanitor() {
+	ticker := time.NewTicker(time.Second * constants.DATA_JANITOR_INTERVAL)
+	defer ticker.Stop()
+
+	svc.updateQueueMetrics()
+
+	for {
+		select {
+		case <-svc.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		purged, err := svc.Store.PurgeExpiredData(time.Now().Unix())
 		if err != nil {
-			return nil, err
+			slog.Error("Error while purging expired data", "error", err)
+		} else if purged > 0 {
+			slog.Info("Purged expired data", "count", purged)
 		}
-		s = sqlStore
 
-	case "redis":
-		portString := strconv.FormatUint(uint64(cfg.Redis.Port), 10)
-		dbInt := int(cfg.Redis.DB)
-		redisStore, err := redis.New(cfg.Redis.Host, portString, cfg.Redis.Password, dbInt)
+		if _, err := svc.Store.PurgeExpiredFederationMessages(time.Now().Unix()); err != nil {
+			slog.Error("Error while purging seen federation messages", "error", err)
+		}
+
+		svc.updateQueueMetrics()
+	}
+}
+
+// updateQueueMetrics refreshes the gauges of undelivered data held in storage.
+func (svc *DataService) updateQueueMetrics() {
+	totalBytes, count, err := svc.Store.GetTotalUsage()
+	if err != nil {
+		slog.Error("Error while measuring queued data", "error", err)
+		return
+	}
+
+	metrics.QueuedBytes.WithLabelValues(svc.Cfg.DataStorage).Set(float64(totalBytes))
+	metrics.QueuedMessages.WithLabelValues(svc.Cfg.DataStorage).Set(float64(count))
+}
+
+// runFanout relays new data notifications from other server instances to our local Hub.
+// Whenever notifications may have been missed, every local subscriber is woken up to check its mailbox.
+func (svc *DataService) runFanout() {
+	onNotify := func(recipientId string) {
+		if recipientId == "" {
+			svc.Hub.NotifyAll()
+			return
+		}
+		svc.Hub.Notify(recipientId)
+	}
+
+	for {
+		err := svc.Fanout.Listen(svc.ctx, onNotify)
+		if svc.ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			return nil, err
+			slog.Error("Notification fan-out listener failed, retrying.", "error", err)
+		}
+
+		// Nothing was relayed while the listener was down.
+		svc.Hub.NotifyAll()
+
+		select {
+		case <-svc.ctx.Done():
+			return
+		case <-time.After(time.Second):
 		}
-		s = redisStore
-	default:
-		return nil, fmt.Errorf("Unknown DataStorage type (%s)", cfg.DataStorage)
 	}
+}
+
+// notifyRecipient wakes up the recipient's waiting long-polls, on this and every other server instance.
+func (svc *DataService) notifyRecipient(recipientId string) {
+	svc.Hub.Notify(recipientId)
 
-	return &DataService{Store: s, Cfg: cfg, UserStore: userStore}, nil
+	if svc.Fanout != nil {
+		if err := svc.Fanout.Publish(recipientId); err != nil {
+			slog.Error("Failed to publish new data notification.", "recipientId", recipientId, "error", err)
+		}
+	}
 }
 
-func (svc *DataService) GetLatestData(userId string) ([]byte, error) {
-	return svc.Store.GetLatestData(userId)
+// GetLatestData returns the blobs stored for userId that deviceId did not acknowledge yet.
+func (svc *DataService) GetLatestData(userId string, deviceId string) ([]byte, error) {
+	return svc.Store.GetLatestData(userId, deviceId)
 }
 
-func (svc *DataService) DeleteAck(userId string, acks []string) error {
+// GetDataSince returns the blobs stored for userId after the blob with afterId, that deviceId did not acknowledge yet.
+// ok is false if the storage backend has no ordered row IDs to resume from.
+func (svc *DataService) GetDataSince(userId string, deviceId string, afterId int64) (records []storage.DataRecord, ok bool, err error) {
+	streamer, ok := svc.Store.(storage.DataStreamer)
+	if !ok {
+		return nil, false, nil
+	}
+
+	records, err = streamer.GetDataSince(userId, deviceId, afterId)
+	return records, true, err
+}
+
+// DeleteAck records that deviceId received the acknowledged blobs, which are deleted once the ack policy is met.
+func (svc *DataService) DeleteAck(userId string, deviceId string, acks []string) error {
 	var err error
 	args := make([][]byte, len(acks))
 	for i, v := range acks {
@@ -88,28 +326,60 @@ func (svc *DataService) DeleteAck(userId string, acks []string) error {
 		}
 	}
 
-	return svc.Store.DeleteAck(userId, args)
+	requiredAcks, err := svc.requiredAcks(userId)
+	if err != nil {
+		return err
+	}
+
+	return svc.Store.DeleteAck(userId, deviceId, args, requiredAcks)
+}
+
+// RemoveDeviceAcks forgets the acknowledgements of a removed device, deleting the blobs every remaining device acknowledged.
+func (svc *DataService) RemoveDeviceAcks(userId string, deviceId string) error {
+	requiredAcks, err := svc.requiredAcks(userId)
+	if err != nil {
+		return err
+	}
+
+	return svc.Store.RemoveDeviceAcks(userId, deviceId, requiredAcks)
+}
 
+// requiredAcks returns how many devices must acknowledge a blob of userId before it is deleted.
+func (svc *DataService) requiredAcks(userId string) (int, error) {
+	if svc.Cfg.Devices.AckPolicy == "any" {
+		return 1, nil
+	}
+
+	// UserStorage only lists the additional devices, not the primary one.
+	devices, err := svc.UserStore.ListDevices(userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(devices) + 1, nil
 }
 
-func (svc *DataService) InsertData(data []byte, senderId string, recipientId string) error {
+// InsertData stores data for a local recipient, or relays it to a federated one.
+// ttl is in seconds, 0 means the server's maximum retention, and is not relayed to federated servers.
+// It returns true when the remote server was unreachable and the message was put in the outbound queue instead.
+func (svc *DataService) InsertData(data []byte, senderId string, recipientId string, ttl int64) (bool, error) {
 	if utils.IsAllDigits(recipientId) {
 		if len(recipientId) != 16 {
-			return errors.New("Recipient is of invalid length")
+			return false, errors.New("Recipient is of invalid length")
 		}
 
 		exists, err := svc.UserStore.CheckUserIdExists(recipientId)
 		if err != nil {
-			return err
+			return false, err
 		}
 		if !exists {
-			return fmt.Errorf("Recipient (%s) does not exist!", recipientId)
+			return false, fmt.Errorf("Recipient (%s) does not exist!", recipientId)
 		}
 
 		senderIdBytes := []byte(senderId)
 
 		if bytes.Contains(senderIdBytes, []byte{constants.COLDWIRE_DATA_SEP}) {
-			return fmt.Errorf("Sender Id (%s) has the COLDWIRE_DATA_SEP in it!", senderId)
+			return false, fmt.Errorf("Sender Id (%s) has the COLDWIRE_DATA_SEP in it!", senderId)
 		}
 
 		var newDataBlob []byte
@@ -120,32 +390,38 @@ func (svc *DataService) InsertData(data []byte, senderId string, recipientId str
 
 		newDataBlob, err = PrependLengthPrefix(newDataBlob, constants.COLDWIRE_LEN_OFFSET)
 		if err != nil {
-			return err
+			return false, err
 		}
 
-		ackId, err := utils.SecureRandomBytes(32)
+		ackId, err := utils.SecureRandomBytes(constants.ACK_ID_LEN)
 		if err != nil {
-			return err
+			return false, err
+		}
+
+		if err := svc.Store.InsertData(newDataBlob, ackId, recipientId, svc.dataExpiry(ttl), svc.mailboxQuota()); err != nil {
+			return false, err
 		}
+		metrics.DataInserted.WithLabelValues(svc.Cfg.DataStorage).Add(float64(len(newDataBlob)))
 
-		return svc.Store.InsertData(newDataBlob, ackId, recipientId)
+		svc.notifyRecipient(recipientId)
+		return false, nil
 
 		// Max DNS length is 253, 16 for recipient user ID, and 1 for `@`
 	} else if len(recipientId) > 253+16+1 || len(recipientId) <= 17 {
-		return errors.New("Invalid recipient ID or address")
+		return false, errors.New("Invalid recipient ID or address")
 
 	} else {
 		if !svc.Cfg.FederationEnabled {
-			return errors.New("Federation support is disabled on this server.")
+			return false, errors.New("Federation support is disabled on this server.")
 		}
 
 		recipientSplit := strings.SplitN(recipientId, "@", 2)
 		if len(recipientSplit) != 2 {
-			return errors.New("Invalid recipient format")
+			return false, errors.New("Invalid recipient format")
 		}
 
 		if !utils.IsAllDigits(recipientSplit[0]) || len(recipientSplit[0]) != 16 {
-			return errors.New("Invalid recipient ID")
+			return false, errors.New("Invalid recipient ID")
 		}
 
 		url := strings.TrimSpace(recipientSplit[1])
@@ -153,20 +429,12 @@ func (svc *DataService) InsertData(data []byte, senderId string, recipientId str
 
 		if url == svc.Cfg.DomainOrIP {
 			// If user sends to a recipient with same address as our server, we simply remove the address and treat it as normal data insert.
-			return svc.InsertData(data, senderId, recipientSplit[0])
+			return svc.InsertData(data, senderId, recipientSplit[0], ttl)
 
 		} else {
-			ourPrivateKeyCasted, err := crypto.PrivateKeyFromBytes(svc.Cfg.DSAPrivateKey)
-			if err != nil {
-				return err
-			}
-
-			dataToSign := []byte(url + recipientSplit[0] + senderId)
-			dataToSign = append(dataToSign, data...)
-
-			signature, err := crypto.CreateSignature(ourPrivateKeyCasted, dataToSign, nil)
+			messageId, err := utils.SecureRandomBytes(constants.FEDERATION_MESSAGE_ID_LEN)
 			if err != nil {
-				return err
+				return false, err
 			}
 
 			metadataToSend := types.FederationSendRequest{
@@ -175,24 +443,39 @@ func (svc *DataService) InsertData(data []byte, senderId string, recipientId str
 				Url:       svc.Cfg.DomainOrIP,
 			}
 
-			blobToSend := append(signature, data...)
+			err = svc.deliverFederation(context.Background(), url, metadataToSend, messageId, data)
+			if err == nil {
+				return false, nil
+			}
+
+			if !isRetryable(err) {
+				return false, err
+			}
 
-			err = sendToServer("https://"+url, metadataToSend, blobToSend)
+			slog.Warn("Federation delivery failed, queueing for later delivery.", "url", url, "error", err)
+
+			now := time.Now().Unix()
+			err = svc.Store.EnqueueOutbound(storage.OutboundMessage{
+				Url:         url,
+				Sender:      senderId,
+				Recipient:   recipientSplit[0],
+				Blob:        data,
+				MessageId:   messageId,
+				CreatedAt:   now,
+				Attempts:    1,
+				NextAttempt: now + svc.outboundBackoff(1),
+			})
 			if err != nil {
-				err = sendToServer("http://"+url, metadataToSend, blobToSend)
-				if err != nil {
-					return err
-				}
+				return false, err
 			}
 
+			metrics.FederationSent.WithLabelValues(url, "queued").Inc()
+			return true, nil
 		}
-
 	}
-
-	return nil
 }
 
-func sendToServer(url string, metadata types.FederationSendRequest, blob []byte) error {
+func (svc *DataService) sendToServer(ctx context.Context, url string, metadata types.FederationSendRequest, blob []byte) error {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
 
@@ -215,13 +498,13 @@ func sendToServer(url string, metadata types.FederationSendRequest, blob []byte)
 
 	writer.Close()
 
-	req, err := http.NewRequest("POST", url+"/federation/send", body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url+"/federation/send", body)
 	if err != nil {
 		return err
 	}
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := svc.FederationClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -232,20 +515,62 @@ func sendToServer(url string, metadata types.FederationSendRequest, blob []byte)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server error %s %d %s", url, resp.StatusCode, string(bodyBytes))
+		return &RemoteError{Url: url, StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	return nil
 }
 
-func (svc *DataService) FederationProcessor(senderId string, recipientId string, url string, data_blob []byte) error {
+// LegacyFederationAllowed reports whether messages from servers running older versions, without a signed timestamp
+// nor message ID, are still accepted, until the Federation_legacy_until date.
+func (svc *DataService) LegacyFederationAllowed() bool {
+	if svc.Cfg.FederationLegacy == "" {
+		return false
+	}
+
+	until, err := time.Parse("2006-01-02", svc.Cfg.FederationLegacy)
+	if err != nil {
+		return false
+	}
+
+	return time.Now().UTC().Before(until)
+}
+
+// FederationProcessor verifies and stores a message sent by the federated server metadata.Url.
+// Messages signed outside the replay window are rejected, and so are message IDs already received from that server.
+// Legacy messages, without a timestamp nor message ID, are only accepted while LegacyFederationAllowed.
+func (svc *DataService) FederationProcessor(metadata types.FederationSendRequest, data_blob []byte) error {
+	senderId, recipientId, url := metadata.Sender, metadata.Recipient, metadata.Url
+
 	if len(data_blob) <= constants.ML_DSA_87_SIGN_LEN {
 		return errors.New("Malformed signature and blob")
 	}
 
+	// Servers running older versions sign neither a timestamp nor a message ID.
+	legacy := metadata.MessageId == "" && metadata.Timestamp == 0
+	if legacy && !svc.LegacyFederationAllowed() {
+		return ErrLegacyFederation
+	}
+
+	window := int64(svc.Cfg.FederationReplay)
+	now := time.Now().Unix()
+
+	var messageId []byte
+	if !legacy {
+		var err error
+		messageId, err = hex.DecodeString(metadata.MessageId)
+		if err != nil || len(messageId) != constants.FEDERATION_MESSAGE_ID_LEN {
+			return fmt.Errorf("Malformed message ID (%s)", metadata.MessageId)
+		}
+
+		if metadata.Timestamp < now-window || metadata.Timestamp > now+window {
+			return fmt.Errorf("Message timestamp (%d) is outside the replay window, our time is %d", metadata.Timestamp, now)
+		}
+	}
+
 	exists, err := svc.UserStore.CheckUserIdExists(recipientId)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrFederationUnavailable, err)
 	}
 	if !exists {
 		return fmt.Errorf("Recipient (%s) does not exist!", recipientId)
@@ -253,19 +578,19 @@ func (svc *DataService) FederationProcessor(senderId string, recipientId string,
 
 	publicKey, refetchDate, err := svc.GetServerInfo(url)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrFederationUnavailable, err)
 	}
 
 	if publicKey == nil {
 		publicKey, refetchDate, err = svc.FetchAndSaveServerInfo(url)
 		if err != nil {
-			return err
+			return serverInfoFetchError(err)
 		}
 	}
 
 	refetchUTC, err := time.Parse("2006-01-02", refetchDate)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", ErrFederationUnavailable, err)
 	}
 
 	todayUTC := time.Now().UTC().Truncate(24 * time.Hour)
@@ -274,17 +599,31 @@ func (svc *DataService) FederationProcessor(senderId string, recipientId string,
 	if !todayUTC.Before(refetchUTC) {
 		publicKey, refetchDate, err = svc.FetchAndSaveServerInfo(url)
 		if err != nil {
-			return err
+			return serverInfoFetchError(err)
 		}
 	}
 
 	signature := data_blob[:constants.ML_DSA_87_SIGN_LEN]
 	blob := data_blob[constants.ML_DSA_87_SIGN_LEN:]
 
-	signatureData := []byte(svc.Cfg.DomainOrIP + recipientId + senderId)
-	signatureData = append(signatureData, blob...)
+	var signatureData []byte
+	if legacy {
+		signatureData = append([]byte(svc.Cfg.DomainOrIP+recipientId+senderId), blob...)
+	} else {
+		signatureData = federationSignedData(svc.Cfg.DomainOrIP, metadata, messageId, blob)
+	}
 
 	isValidSignature := crypto.VerifySignature(publicKey, signatureData, nil, signature)
+
+	// The server may have rotated its key since we fetched it, but forged requests must not make us refetch it each time.
+	if !isValidSignature && svc.keyRefetchDue(url) {
+		publicKey, _, err = svc.FetchAndSaveServerInfo(url)
+		if err != nil {
+			return serverInfoFetchError(err)
+		}
+		isValidSignature = crypto.VerifySignature(publicKey, signatureData, nil, signature)
+	}
+
 	if !isValidSignature {
 		return fmt.Errorf("Invalid signature, while processing federation request.")
 	}
@@ -306,23 +645,67 @@ func (svc *DataService) FederationProcessor(senderId string, recipientId string,
 		return err
 	}
 
-	ackId, err := utils.SecureRandomBytes(32)
+	ackId, err := utils.SecureRandomBytes(constants.ACK_ID_LEN)
 	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFederationUnavailable, err)
+	}
+
+	// Only recorded once the signature checked out, so forged requests can't burn message IDs.
+	// It is kept until the timestamp alone is enough to reject the message, and for as long as the sender may retry
+	// it from its queue under a new timestamp, assuming the sender keeps messages queued as long as we do.
+	if !legacy {
+		seenUntil := max(metadata.Timestamp+window, now+int64(svc.Cfg.FederationQueue.MaxAgeHours)*3600+window) + 1
+		firstSeen, err := svc.Store.MarkFederationMessageSeen(url, messageId, seenUntil)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrFederationUnavailable, err)
+		}
+		if !firstSeen {
+			return fmt.Errorf("%w: message (%s) from %s", ErrFederationReplay, metadata.MessageId, url)
+		}
+	}
+
+	if err := svc.Store.InsertData(newDataBlob, ackId, recipientId, svc.dataExpiry(0), svc.mailboxQuota()); err != nil {
+		if !legacy {
+			// The sender retries messages we failed to store, they must not be taken for replays.
+			if unmarkErr := svc.Store.UnmarkFederationMessageSeen(url, messageId); unmarkErr != nil {
+				slog.Error("Error while forgetting a federation message that could not be stored.", "url", url, "message_id", metadata.MessageId, "error", unmarkErr)
+			}
+		}
+
+		if errors.Is(err, ErrMailboxFull) {
+			return err
+		}
+		return fmt.Errorf("%w: %w", ErrFederationUnavailable, err)
+	}
+	metrics.DataInserted.WithLabelValues(svc.Cfg.DataStorage).Add(float64(len(newDataBlob)))
+
+	svc.notifyRecipient(recipientId)
+	return nil
+}
+
+// serverInfoFetchError wraps a failure to fetch a federated server's key in ErrFederationUnavailable, unless the
+// server itself is at fault: its key changed without rotations or its address is blacklisted.
+func serverInfoFetchError(err error) error {
+	if errors.Is(err, ErrServerKeyChanged) || errors.Is(err, ErrBlockedAddress) {
 		return err
 	}
-	return svc.Store.InsertData(newDataBlob, ackId, recipientId)
+	return fmt.Errorf("%w: %w", ErrFederationUnavailable, err)
 }
 
 func (svc *DataService) FetchAndSaveServerInfo(url string) (*mldsa87.PublicKey, string, error) {
-	resp, err := http.Get("https://" + url + "/federation/info")
+	resp, err := svc.FederationClient.Get("https://" + url + "/federation/info")
+	if err != nil && !errors.Is(err, ErrBlockedAddress) && svc.allowPlaintext(url) {
+		resp, err = svc.FederationClient.Get("http://" + url + "/federation/info")
+	}
 	if err != nil {
-		resp, err = http.Get("http://" + url + "/federation/info")
-		if err != nil {
-			return nil, "", err
-		}
+		return nil, "", err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &RemoteError{Url: url, StatusCode: resp.StatusCode}
+	}
+
 	var result types.FederationInfoResponse
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, "", err
@@ -347,6 +730,20 @@ func (svc *DataService) FetchAndSaveServerInfo(url string) (*mldsa87.PublicKey,
 		return nil, "", fmt.Errorf("Invalid signature, while fetching for server (%s) info", url)
 	}
 
+	// Trust on first use, afterwards the key only changes through rotations signed by the pinned key.
+	pinnedKey, _, err := svc.UserStore.GetServerInfo(url)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if pinnedKey != nil && !bytes.Equal(pinnedKey, result.PublicKey) {
+		if err := followKeyRotations(url, pinnedKey, result.PublicKey, result.KeyRotations); err != nil {
+			slog.Warn("Federated server presented a key we can't verify, refusing it.", "url", url, "error", err)
+			return nil, "", err
+		}
+		slog.Info("Federated server rotated its key.", "url", url)
+	}
+
 	err = svc.UserStore.SaveServerInfo(url, result.PublicKey, result.RefetchDate)
 	if err != nil {
 		return nil, "", err
@@ -355,6 +752,55 @@ func (svc *DataService) FetchAndSaveServerInfo(url string) (*mldsa87.PublicKey,
 	return publicKeyCasted, result.RefetchDate, nil
 }
 
+// followKeyRotations checks that rotations, oldest first, lead from the pinned key to the current one,
+// each of them signed by the key it replaces.
+func followKeyRotations(url string, pinnedKey []byte, currentKey []byte, rotations []types.FederationKeyRotation) error {
+	key := pinnedKey
+	for _, rotation := range rotations {
+		if bytes.Equal(key, currentKey) {
+			break
+		}
+
+		if !bytes.Equal(rotation.PreviousPublicKey, key) {
+			continue
+		}
+
+		if !crypto.VerifyKeyRotation(url, rotation.PreviousPublicKey, rotation.PublicKey, rotation.Signature) {
+			return fmt.Errorf("%w: invalid key rotation signature from server (%s)", ErrServerKeyChanged, url)
+		}
+		key = rotation.PublicKey
+	}
+
+	if !bytes.Equal(key, currentKey) {
+		return fmt.Errorf("%w: server (%s) has no key rotation from the pinned key", ErrServerKeyChanged, url)
+	}
+
+	return nil
+}
+
+// keyRefetchDue reports whether the key of url may be refetched, at most once per FEDERATION_KEY_REFETCH_COOLDOWN.
+func (svc *DataService) keyRefetchDue(url string) bool {
+	now := time.Now().Unix()
+
+	svc.keyRefetchMu.Lock()
+	defer svc.keyRefetchMu.Unlock()
+
+	if now-svc.keyRefetches[url] < constants.FEDERATION_KEY_REFETCH_COOLDOWN {
+		return false
+	}
+
+	// Refetches past their cooldown no longer matter, forgetting them bounds the map by the servers
+	// refetched within one cooldown instead of every server that ever sent an invalid signature.
+	for refetchedUrl, refetchedAt := range svc.keyRefetches {
+		if now-refetchedAt >= constants.FEDERATION_KEY_REFETCH_COOLDOWN {
+			delete(svc.keyRefetches, refetchedUrl)
+		}
+	}
+
+	svc.keyRefetches[url] = now
+	return true
+}
+
 func (svc *DataService) GetServerInfo(url string) (*mldsa87.PublicKey, string, error) {
 	publicKey, refetchDate, err := svc.UserStore.GetServerInfo(url)
 	if err != nil {
@@ -389,3 +835,30 @@ func PrependLengthPrefix(payload []byte, lengthBytes int) ([]byte, error) {
 
 	return append(lengthPrefix, payload...), nil
 }
+
+// SplitDataBlobs splits the output of GetLatestData into individual blobs,
+// each one still prefixed with its ack ID and length, exactly as the long-poll returns them.
+func SplitDataBlobs(allData []byte) ([][]byte, error) {
+	var blobs [][]byte
+
+	for len(allData) > 0 {
+		headerLen := constants.ACK_ID_LEN + constants.COLDWIRE_LEN_OFFSET
+		if len(allData) < headerLen {
+			return nil, errors.New("Truncated data blob header")
+		}
+
+		length := 0
+		for _, b := range allData[constants.ACK_ID_LEN:headerLen] {
+			length = length<<8 | int(b)
+		}
+
+		if len(allData) < headerLen+length {
+			return nil, errors.New("Truncated data blob")
+		}
+
+		blobs = append(blobs, allData[:headerLen+length])
+		allData = allData[headerLen+length:]
+	}
+
+	return blobs, nil
+}
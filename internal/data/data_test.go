@@ -0,0 +1,242 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
+)
+
+func TestSplitDataBlobs(t *testing.T) {
+	var (
+		allData  []byte
+		expected [][]byte
+	)
+
+	for _, payload := range [][]byte{[]byte("1234567890123456\x00hello"), bytes.Repeat([]byte{0xAA}, 70000)} {
+		ackId, err := utils.SecureRandomBytes(constants.ACK_ID_LEN)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		prefixed, err := PrependLengthPrefix(payload, constants.COLDWIRE_LEN_OFFSET)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blob := append(ackId, prefixed...)
+		expected = append(expected, blob)
+		allData = append(allData, blob...)
+	}
+
+	blobs, err := SplitDataBlobs(allData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blobs) != len(expected) {
+		t.Fatalf("expected %d blobs, got %d", len(expected), len(blobs))
+	}
+
+	for i := range blobs {
+		if !bytes.Equal(blobs[i], expected[i]) {
+			t.Fatalf("blob %d does not match", i)
+		}
+	}
+
+	if _, err := SplitDataBlobs(allData[:len(allData)-1]); err == nil {
+		t.Fatal("truncated data was accepted")
+	}
+}
+
+func TestFollowKeyRotations(t *testing.T) {
+	const url = "example.com"
+
+	var (
+		publicKeys  [][]byte
+		privateKeys []*mldsa87.PrivateKey
+	)
+	for i := 0; i < 3; i++ {
+		publicKey, privateKey, err := crypto.CreateDSAKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publicKeyBytes, err := publicKey.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publicKeys = append(publicKeys, publicKeyBytes)
+		privateKeys = append(privateKeys, privateKey)
+	}
+
+	var rotations []types.FederationKeyRotation
+	for i := 0; i < 2; i++ {
+		signature, err := crypto.SignKeyRotation(privateKeys[i], url, publicKeys[i], publicKeys[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotations = append(rotations, types.FederationKeyRotation{PreviousPublicKey: publicKeys[i], PublicKey: publicKeys[i+1], Signature: signature})
+	}
+
+	for pinned := 0; pinned < 2; pinned++ {
+		if err := followKeyRotations(url, publicKeys[pinned], publicKeys[2], rotations); err != nil {
+			t.Fatalf("rotation from key %d rejected: %v", pinned, err)
+		}
+	}
+
+	if err := followKeyRotations("other.example.com", publicKeys[0], publicKeys[2], rotations); !errors.Is(err, ErrServerKeyChanged) {
+		t.Fatalf("rotations signed for another server accepted: %v", err)
+	}
+
+	if err := followKeyRotations(url, publicKeys[0], publicKeys[2], nil); !errors.Is(err, ErrServerKeyChanged) {
+		t.Fatalf("key change without rotations accepted: %v", err)
+	}
+
+	if err := followKeyRotations(url, publicKeys[2], publicKeys[0], rotations); !errors.Is(err, ErrServerKeyChanged) {
+		t.Fatalf("rotation back to an older key accepted: %v", err)
+	}
+}
+
+// pinnedServerStore pins one server key and records the keys saved over it.
+type pinnedServerStore struct {
+	storage.UserStorage
+	pinnedKey []byte
+	saved     [][]byte
+}
+
+func (s *pinnedServerStore) GetServerInfo(url string) ([]byte, string, error) {
+	return s.pinnedKey, "", nil
+}
+
+func (s *pinnedServerStore) SaveServerInfo(url string, publicKey []byte, refetchDate string) error {
+	s.saved = append(s.saved, publicKey)
+	return nil
+}
+
+func TestFetchAndSaveServerInfoRefusesUnrotatedKeyChange(t *testing.T) {
+	pinnedKey, _, err := crypto.CreateDSAKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinnedKeyBytes, err := pinnedKey.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, privateKey, err := crypto.CreateDSAKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var url string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const refetchDate = "2030-01-01"
+
+		// A validly signed response, only not under the key we pinned.
+		signature, err := crypto.CreateSignature(privateKey, []byte(url+refetchDate), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		json.NewEncoder(w).Encode(types.FederationInfoResponse{Signature: signature, PublicKey: publicKeyBytes, RefetchDate: refetchDate})
+	}))
+	defer srv.Close()
+
+	url = srv.Listener.Addr().String()
+
+	cfg := &config.Config{}
+	cfg.FederationClient.ConnectTimeoutSeconds = 5
+	cfg.FederationClient.ResponseTimeoutSeconds = 5
+	cfg.FederationClient.MaxResponseBytes = constants.FEDERATION_MAX_RESPONSE_BYTES
+
+	client, err := NewFederationClient(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &pinnedServerStore{pinnedKey: pinnedKeyBytes}
+	svc := &DataService{Cfg: cfg, UserStore: store, FederationClient: client}
+
+	if _, _, err := svc.FetchAndSaveServerInfo(url); !errors.Is(err, ErrServerKeyChanged) {
+		t.Fatalf("expected ErrServerKeyChanged, got %v", err)
+	}
+
+	if len(store.saved) != 0 {
+		t.Fatal("unrotated key change was saved over the pinned key")
+	}
+
+	store.pinnedKey = nil
+	if _, _, err := svc.FetchAndSaveServerInfo(url); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.saved) != 1 || !bytes.Equal(store.saved[0], publicKeyBytes) {
+		t.Fatal("key of a server seen for the first time was not pinned")
+	}
+}
+
+func TestFederationProcessorRejectsLegacyMessagesAfterTransition(t *testing.T) {
+	svc := &DataService{Cfg: &config.Config{}}
+	legacy := types.FederationSendRequest{Sender: "1111111111111111", Recipient: "2222222222222222", Url: "example.com"}
+	blob := make([]byte, constants.ML_DSA_87_SIGN_LEN+1)
+
+	if err := svc.FederationProcessor(legacy, blob); !errors.Is(err, ErrLegacyFederation) {
+		t.Fatalf("expected ErrLegacyFederation without a transition date, got %v", err)
+	}
+
+	svc.Cfg.FederationLegacy = time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	if err := svc.FederationProcessor(legacy, blob); !errors.Is(err, ErrLegacyFederation) {
+		t.Fatalf("expected ErrLegacyFederation past the transition date, got %v", err)
+	}
+
+	svc.Cfg.FederationLegacy = time.Now().UTC().AddDate(0, 0, 2).Format("2006-01-02")
+	if !svc.LegacyFederationAllowed() {
+		t.Fatal("legacy messages are rejected before the transition date")
+	}
+}
+
+// unavailableUserStore fails every lookup, as a storage that can't be reached.
+type unavailableUserStore struct {
+	storage.UserStorage
+}
+
+func (s *unavailableUserStore) CheckUserIdExists(userId string) (bool, error) {
+	return false, errors.New("connection refused")
+}
+
+func TestFederationProcessorReportsStorageFailuresAsUnavailable(t *testing.T) {
+	svc := &DataService{Cfg: &config.Config{FederationReplay: constants.FEDERATION_REPLAY_WINDOW}, UserStore: &unavailableUserStore{}}
+	metadata := types.FederationSendRequest{
+		Sender:    "1111111111111111",
+		Recipient: "2222222222222222",
+		Url:       "example.com",
+		MessageId: strings.Repeat("01", constants.FEDERATION_MESSAGE_ID_LEN),
+		Timestamp: time.Now().Unix(),
+	}
+
+	err := svc.FederationProcessor(metadata, make([]byte, constants.ML_DSA_87_SIGN_LEN+1))
+	if !errors.Is(err, ErrFederationUnavailable) {
+		t.Fatalf("expected ErrFederationUnavailable, got %v", err)
+	}
+}
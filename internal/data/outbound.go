@@ -0,0 +1,197 @@
+package data
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/metrics"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
+)
+
+// RemoteError is returned when a federated server answered, but did not accept our request.
+type RemoteError struct {
+	Url        string
+	StatusCode int
+	Body       string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("server error %s %d %s", e.Url, e.StatusCode, e.Body)
+}
+
+// isRetryable reports whether a failed delivery may succeed later.
+// A remote server rejecting the message (e.g. unknown recipient) will keep rejecting it.
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrBlockedAddress) {
+		return false
+	}
+
+	var remoteErr *RemoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.StatusCode >= 500 || remoteErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// federationSignedData returns what the signature of a federation message covers, recipientServer being the
+// server it is sent to. The fixed-size timestamp and message ID come first, so they can't run into the other fields.
+func federationSignedData(recipientServer string, metadata types.FederationSendRequest, messageId []byte, data []byte) []byte {
+	signed := binary.BigEndian.AppendUint64(nil, uint64(metadata.Timestamp))
+	signed = append(signed, messageId...)
+	signed = append(signed, recipientServer+metadata.Recipient+metadata.Sender...)
+	return append(signed, data...)
+}
+
+// deliverFederation signs a message with the current time and sends it to a federated server, falling back to
+// plain HTTP only if the server could not be reached over HTTPS at all, and plaintext is allowed for it.
+// Every attempt at delivering the same message must use the same messageId, so the remote server can drop duplicates.
+// The delivery is abandoned once ctx is done.
+func (svc *DataService) deliverFederation(ctx context.Context, url string, metadata types.FederationSendRequest, messageId []byte, data []byte) error {
+	ourPrivateKey, err := crypto.PrivateKeyFromBytes(svc.Cfg.DSAPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	metadata.Timestamp = time.Now().Unix()
+	metadata.MessageId = hex.EncodeToString(messageId)
+
+	signature, err := crypto.CreateSignature(ourPrivateKey, federationSignedData(url, metadata, messageId, data), nil)
+	if err != nil {
+		return err
+	}
+
+	blob := append(signature, data...)
+
+	err = svc.sendToServer(ctx, "https://"+url, metadata, blob)
+
+	var remoteErr *RemoteError
+	if err != nil && !errors.As(err, &remoteErr) && !errors.Is(err, ErrBlockedAddress) && svc.allowPlaintext(url) {
+		err = svc.sendToServer(ctx, "http://"+url, metadata, blob)
+	}
+
+	// The remote server already accepted this message, the response to an earlier attempt must have been lost.
+	if errors.As(err, &remoteErr) && remoteErr.StatusCode == http.StatusConflict {
+		err = nil
+	}
+
+	switch {
+	case err == nil:
+		metrics.FederationSent.WithLabelValues(url, "delivered").Inc()
+	case isRetryable(err):
+		metrics.FederationSent.WithLabelValues(url, "failed").Inc()
+	default:
+		metrics.FederationSent.WithLabelValues(url, "rejected").Inc()
+	}
+
+	return err
+}
+
+// outboundBackoff returns how many seconds to wait before the next delivery attempt,
+// doubling with every attempt up to the configured maximum.
+func (svc *DataService) outboundBackoff(attempts int) int64 {
+	backoff := int64(svc.Cfg.FederationQueue.InitialBackoffSeconds)
+	maxBackoff := int64(svc.Cfg.FederationQueue.MaxBackoffSeconds)
+
+	for i := 1; i < attempts && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, maxBackoff)
+}
+
+func (svc *DataService) runOutboundQueue() {
+	ticker := time.NewTicker(time.Second * constants.FEDERATION_QUEUE_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-svc.ctx.Done():
+			return
+		case <-ticker.C:
+			svc.processOutboundQueue(svc.ctx)
+		}
+	}
+}
+
+// drainOutboundQueue delivers due outbound messages until none is left or ctx is done, so messages queued just
+// before a shutdown aren't held until the next start. Messages backing off after a failed attempt stay queued.
+func (svc *DataService) drainOutboundQueue(ctx context.Context) {
+	for ctx.Err() == nil && svc.processOutboundQueue(ctx) > 0 {
+	}
+}
+
+// processOutboundQueue retries a batch of due messages in the outbound queue once, stopping between deliveries
+// once ctx is done. It returns how many messages it handled, either delivered, dropped or rescheduled.
+func (svc *DataService) processOutboundQueue(ctx context.Context) int {
+	now := time.Now().Unix()
+	maxAge := int64(svc.Cfg.FederationQueue.MaxAgeHours) * 3600
+
+	msgs, err := svc.Store.GetDueOutbound(now, constants.FEDERATION_QUEUE_BATCH)
+	if err != nil {
+		slog.Error("Error while fetching outbound federation queue", "error", err)
+		return 0
+	}
+
+	handled := 0
+	for _, msg := range msgs {
+		// Stop between deliveries on shutdown, the remaining messages stay queued.
+		if ctx.Err() != nil {
+			return handled
+		}
+
+		if now-msg.CreatedAt > maxAge {
+			slog.Warn("Giving up on outbound federation message, it is too old.", "url", msg.Url, "recipient", msg.Recipient, "attempts", msg.Attempts)
+			svc.deleteOutbound(msg)
+			handled++
+			continue
+		}
+
+		// Reschedule before delivering, so other instances (and a crash) can't cause a double delivery.
+		attempts := msg.Attempts + 1
+		claimed, err := svc.Store.ClaimOutbound(msg.Id, msg.NextAttempt, attempts, now+svc.outboundBackoff(attempts))
+		if err != nil {
+			slog.Error("Error while claiming outbound federation message", "id", msg.Id, "error", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		handled++
+
+		err = svc.deliverFederation(svc.deliveries, msg.Url, types.FederationSendRequest{
+			Sender:    msg.Sender,
+			Recipient: msg.Recipient,
+			Url:       svc.Cfg.DomainOrIP,
+		}, msg.MessageId, msg.Blob)
+
+		if err != nil && isRetryable(err) {
+			slog.Warn("Outbound federation delivery failed, will retry.", "url", msg.Url, "recipient", msg.Recipient, "attempts", attempts, "error", err)
+			continue
+		}
+
+		if err != nil {
+			slog.Error("Outbound federation message rejected by remote server, dropping it.", "url", msg.Url, "recipient", msg.Recipient, "error", err)
+		} else {
+			slog.Info("Delivered queued federation message.", "url", msg.Url, "recipient", msg.Recipient, "attempts", attempts)
+		}
+
+		svc.deleteOutbound(msg)
+	}
+
+	return handled
+}
+
+func (svc *DataService) deleteOutbound(msg storage.OutboundMessage) {
+	if err := svc.Store.DeleteOutbound(msg.Id); err != nil {
+		slog.Error("Error while deleting outbound federation message", "id", msg.Id, "error", err)
+	}
+}
@@ -0,0 +1,144 @@
+package data
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/notify"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/sqlite"
+)
+
+// keepOpenStore ignores ExitCleanup, so the queue can be inspected once the service is closed.
+type keepOpenStore struct {
+	storage.DataStorage
+}
+
+func (s *keepOpenStore) ExitCleanup() error {
+	return nil
+}
+
+// newOutboundTestService returns a service with its workers running, and a message queued for the federated
+// server at url, due right away.
+func newOutboundTestService(t *testing.T, url string) (*DataService, storage.DataStorage) {
+	store, err := sqlite.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, privateKey, err := crypto.CreateDSAKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKeyBytes, err := privateKey.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{DomainOrIP: "example.com", DSAPrivateKey: privateKeyBytes, FederationEnabled: true}
+	cfg.FederationClient.ConnectTimeoutSeconds = 5
+	cfg.FederationClient.ResponseTimeoutSeconds = 5
+	cfg.FederationClient.MaxResponseBytes = constants.FEDERATION_MAX_RESPONSE_BYTES
+	cfg.FederationQueue.MaxAgeHours = 1
+	cfg.FederationQueue.InitialBackoffSeconds = 60
+	cfg.FederationQueue.MaxBackoffSeconds = 60
+
+	client, err := NewFederationClient(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	err = store.EnqueueOutbound(storage.OutboundMessage{
+		Url:         url,
+		Sender:      "1111111111111111",
+		Recipient:   "2222222222222222",
+		Blob:        []byte("hello"),
+		MessageId:   make([]byte, constants.FEDERATION_MESSAGE_ID_LEN),
+		CreatedAt:   now,
+		Attempts:    1,
+		NextAttempt: now,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries, cancelDeliveries := context.WithCancel(context.Background())
+	svc := &DataService{
+		Store:            &keepOpenStore{store},
+		Cfg:              cfg,
+		Hub:              notify.NewHub(),
+		FederationClient: client,
+		ctx:              ctx,
+		cancel:           cancel,
+		deliveries:       deliveries,
+		cancelDeliveries: cancelDeliveries,
+	}
+
+	svc.startWorker(svc.runOutboundQueue)
+	svc.startWorker(svc.runDataJanitor)
+
+	return svc, store
+}
+
+func TestCloseDrainsOutboundQueue(t *testing.T) {
+	var delivered atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered.Add(1)
+	}))
+	defer srv.Close()
+
+	svc, store := newOutboundTestService(t, srv.Listener.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := svc.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if delivered.Load() != 1 {
+		t.Fatalf("expected the queued message to be delivered once on shutdown, got %d deliveries", delivered.Load())
+	}
+
+	if msgs, err := store.GetDueOutbound(time.Now().Unix()+3600, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("delivered message is still queued: %v", err)
+	}
+}
+
+func TestCloseGivesUpOnDeliveriesAtDeadline(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	svc, store := newOutboundTestService(t, srv.Listener.Addr().String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := svc.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Well below the federation client's own timeout.
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Close returned %s after its deadline", elapsed)
+	}
+
+	if msgs, err := store.GetDueOutbound(time.Now().Unix()+3600, 10); err != nil || len(msgs) != 1 {
+		t.Fatalf("undelivered message was not kept for the next start: %v", err)
+	}
+}
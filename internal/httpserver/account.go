@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// accountDeleteHandler deletes the user's account and queued data. On top of a valid access token,
+// it requires a signature over a fresh challenge, so a stolen token alone can't delete an account.
+func (s *Server) accountDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+
+	if !requirePrimaryDevice(w, jwtClaims) {
+		return
+	}
+
+	var payload types.AccountDeleteRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if payload.Signature == "" || payload.Challenge == "" {
+		http.Error(w, "Request missing signature or challenge fields", http.StatusBadRequest)
+		return
+	}
+
+	challengeUserId, _, validSignature, err := s.DbSvcs.UserService.AuthenticateVerificationProcessor(&types.AuthenticateVerificationRequest{
+		Challenge: payload.Challenge,
+		Signature: payload.Signature,
+	})
+	if err != nil {
+		slog.Error("Error while verifying account deletion challenge.", "user_id", userId, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusBadRequest)
+		return
+	}
+
+	if !validSignature || challengeUserId != userId {
+		slog.Warn("Account deletion challenge verification failed!", "user_id", userId, "challenge", payload.Challenge)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	// Purged before the account is deleted, so that if it fails the user still has an account to retry with.
+	purged, err := s.DbSvcs.DataService.Store.PurgeMailbox(userId)
+	if err != nil {
+		slog.Error("Error while purging the mailbox of an account to delete.", "user_id", userId, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+		return
+	}
+
+	deleted, err := s.DbSvcs.UserService.DeleteAccount(userId)
+	if err != nil {
+		slog.Error("Error while deleting account.", "user_id", userId, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+		return
+	}
+
+	if !deleted {
+		http.Error(w, "Account does not exist", http.StatusNotFound)
+		return
+	}
+
+	// Data may have been queued in between, nobody can fetch it anymore.
+	queuedMeanwhile, err := s.DbSvcs.DataService.Store.PurgeMailbox(userId)
+	if err != nil {
+		slog.Error("Account deleted, but purging data queued during the deletion failed.", "user_id", userId, "error", err)
+	}
+	purged += queuedMeanwhile
+
+	slog.Info("Deleted account", "user_id", userId, "purgedMessages", purged)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"success"}`))
+}
@@ -0,0 +1,131 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/sqlite"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// failingPurgeStore fails every mailbox purge.
+type failingPurgeStore struct {
+	storage.DataStorage
+}
+
+func (s *failingPurgeStore) PurgeMailbox(userId string) (int64, error) {
+	return 0, errors.New("storage unavailable")
+}
+
+// deleteAccount sends a signed account deletion request for userId to s.
+func deleteAccount(t *testing.T, s *Server, store *sqlite.SQLiteStorage, userId string, privateKey *mldsa87.PrivateKey) *httptest.ResponseRecorder {
+	challenge, err := utils.SecureRandomBytes(constants.CHALLENGE_LEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	if err := store.SaveChallenge(challenge, userId, nil, now, now+300); err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := crypto.CreateSignature(privateKey, challenge, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(types.AccountDeleteRequest{
+		Challenge: base64.StdEncoding.EncodeToString(challenge),
+		Signature: base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/account/delete", bytes.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), claimsKey, jwt.MapClaims{"user_id": userId}))
+
+	w := httptest.NewRecorder()
+	s.accountDeleteHandler(w, r)
+	return w
+}
+
+func TestAccountDelete(t *testing.T) {
+	store, err := sqlite.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{UserIdCooldown: 1}
+	dataSvc := &data.DataService{Store: &failingPurgeStore{store}, Cfg: cfg}
+	s := &Server{Cfg: cfg, DbSvcs: &DBServices{
+		UserService: &authenticate.UserService{Store: store, Cfg: cfg},
+		DataService: dataSvc,
+	}}
+
+	publicKey, privateKey, err := crypto.CreateDSAKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userId, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveUser(userId, publicKeyBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.InsertData([]byte("hello"), make([]byte, constants.ACK_ID_LEN), userId, 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The account must survive a failed purge, so the user can try again.
+	if w := deleteAccount(t, s, store, userId, privateKey); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500 when the purge fails, got %d", w.Code)
+	}
+
+	if exists, err := store.CheckUserIdExists(userId); err != nil || !exists {
+		t.Fatalf("account deleted although its mailbox was not purged: %v", err)
+	}
+
+	dataSvc.Store = store
+
+	if w := deleteAccount(t, s, store, userId, privateKey); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+	}
+
+	if exists, err := store.CheckUserIdExists(userId); err != nil || exists {
+		t.Fatalf("account was not deleted: %v", err)
+	}
+
+	if _, count, err := store.GetMailboxUsage(userId); err != nil || count != 0 {
+		t.Fatalf("expected an empty mailbox, %d blobs left: %v", count, err)
+	}
+
+	if reserved, err := store.IsUserIdReserved(userId, time.Now().Unix()); err != nil || !reserved {
+		t.Fatalf("deleted user ID was not reserved: %v", err)
+	}
+}
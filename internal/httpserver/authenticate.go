@@ -1,13 +1,19 @@
 package httpserver
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/metrics"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func (s *Server) authenticateInitHandler(w http.ResponseWriter, r *http.Request) {
@@ -39,6 +45,11 @@ func (s *Server) authenticateInitHandler(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	if payload.DeviceID != "" && payload.UserID == "" {
+		http.Error(w, "device_id requires user_id", http.StatusBadRequest)
+		return
+	}
+
 	challengeEncoded, err := s.DbSvcs.UserService.AuthenticateInitProcessor(&payload)
 	if err != nil {
 		slog.Error("Error while processing request.", "error", err, "payload", payload)
@@ -82,17 +93,27 @@ func (s *Server) authenticateVerificationHandler(w http.ResponseWriter, r *http.
 
 	userId, publicKey, validSignature, err := s.DbSvcs.UserService.AuthenticateVerificationProcessor(&payload)
 	if err != nil {
+		metrics.AuthAttempts.WithLabelValues("verify", "failure").Inc()
+		if errors.Is(err, authenticate.ErrUserBanned) {
+			slog.Warn("Banned user tried to authenticate.", "error", err)
+			http.Error(w, "Account is banned", http.StatusForbidden)
+			return
+		}
+
 		slog.Error("Error while processing request.", "error", err, "payload", payload)
 		http.Error(w, "Error while processing request.", http.StatusBadRequest)
 		return
 	}
 
-	if validSignature {
-		slog.Info("Challenge verification passed.", "challenge", payload.Challenge)
-	} else {
+	if !validSignature {
+		metrics.AuthAttempts.WithLabelValues("verify", "failure").Inc()
 		slog.Warn("Challenge verification failed!", "challenge", payload.Challenge)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
 	}
 
+	slog.Info("Challenge verification passed.", "challenge", payload.Challenge)
+
 	if userId == "" {
 		userId, err = s.DbSvcs.UserService.RegisterNewUser(publicKey)
 		if err != nil {
@@ -102,24 +123,167 @@ func (s *Server) authenticateVerificationHandler(w http.ResponseWriter, r *http.
 		}
 	}
 
-	token, err := crypto.CreateJWTToken(map[string]interface{}{
-		"user_id": userId,
-	}, s.Cfg.JWTSecret)
-
+	tokens, err := s.DbSvcs.UserService.IssueTokens(userId, cmp.Or(payload.DeviceID, constants.PRIMARY_DEVICE_ID))
 	if err != nil {
-		slog.Error("F.", "error", err)
+		slog.Error("Error while issuing tokens.", "error", err)
 		http.Error(w, "Error while processing request.", http.StatusBadRequest)
 		return
 	}
 
+	metrics.AuthAttempts.WithLabelValues("verify", "success").Inc()
+	writeTokens(w, userId, tokens)
+}
+
+func (s *Server) authenticateRotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload types.AuthenticateRotateKeyRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if payload.Challenge == "" || payload.NewPublicKey == "" || payload.Signature == "" || payload.NewSignature == "" {
+		http.Error(w, "Request missing challenge, new_public_key, signature or new_signature fields", http.StatusBadRequest)
+		return
+	}
+
+	userId, tokens, err := s.DbSvcs.UserService.RotateKeyProcessor(&payload)
+	if err != nil {
+		metrics.AuthAttempts.WithLabelValues("rotate_key", "failure").Inc()
+
+		switch {
+		case errors.Is(err, authenticate.ErrUserBanned):
+			slog.Warn("Banned user tried to rotate its public-key.", "error", err)
+			http.Error(w, "Account is banned", http.StatusForbidden)
+		case errors.Is(err, authenticate.ErrInvalidKeyRotation):
+			slog.Warn("Public-key rotation verification failed!", "challenge", payload.Challenge, "error", err)
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		default:
+			slog.Error("Error while processing request.", "error", err)
+			http.Error(w, "Error while processing request.", http.StatusBadRequest)
+		}
+		return
+	}
+
+	slog.Info("Rotated user public-key", "user_id", userId)
+
+	metrics.AuthAttempts.WithLabelValues("rotate_key", "success").Inc()
+	writeTokens(w, userId, tokens)
+}
+
+func (s *Server) authenticateRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload types.AuthenticateRefreshRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if payload.RefreshToken == "" {
+		http.Error(w, "Request missing refresh_token field", http.StatusBadRequest)
+		return
+	}
+
+	userId, tokens, err := s.DbSvcs.UserService.RefreshTokens(payload.RefreshToken)
+	if errors.Is(err, authenticate.ErrInvalidToken) {
+		metrics.AuthAttempts.WithLabelValues("refresh", "failure").Inc()
+		slog.Warn("Rejected refresh token", "error", err)
+		http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.Error("Error while refreshing tokens.", "error", err)
+		http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+		return
+	}
+
+	metrics.AuthAttempts.WithLabelValues("refresh", "success").Inc()
+	writeTokens(w, userId, tokens)
+}
+
+func (s *Server) authenticateRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+
+	var payload types.AuthenticateRevokeRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	svc := s.DbSvcs.UserService
+
+	if payload.All {
+		if err := svc.RevokeAllTokens(userId); err != nil {
+			slog.Error("Error while revoking all tokens.", "user_id", userId, "error", err)
+			http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Revoked all sessions", "user_id", userId)
+		w.Write([]byte(`{"status":"success"}`))
+		return
+	}
+
+	if payload.RefreshToken != "" {
+		refreshClaims, err := svc.ValidateToken(payload.RefreshToken, authenticate.RefreshToken)
+		if err == nil && refreshClaims["user_id"] != userId {
+			err = fmt.Errorf("%w: refresh token belongs to another user", authenticate.ErrInvalidToken)
+		}
+		if errors.Is(err, authenticate.ErrInvalidToken) {
+			http.Error(w, "invalid or expired refresh token", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			slog.Error("Error while validating refresh token.", "error", err)
+			http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+			return
+		}
+
+		if _, err := svc.RevokeToken(refreshClaims); err != nil {
+			slog.Error("Error while revoking refresh token.", "user_id", userId, "error", err)
+			http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err := svc.RevokeToken(jwtClaims); err != nil {
+		slog.Error("Error while revoking token.", "user_id", userId, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write([]byte(`{"status":"success"}`))
+}
+
+func writeTokens(w http.ResponseWriter, userId string, tokens *authenticate.TokenPair) {
 	resp := types.AuthenticateVerificationResponse{
-		UserID: userId,
-		Token:  token,
+		UserID:       userId,
+		DeviceID:     tokens.DeviceId,
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
 	}
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		slog.Error("Error while encoding response.", "resp", resp, "error", err)
+		slog.Error("Error while encoding response.", "error", err)
 		http.Error(w, "Error while processing request.", http.StatusBadRequest)
 	}
-
 }
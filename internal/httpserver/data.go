@@ -1,17 +1,32 @@
 package httpserver
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
 )
 
+// upgrader only accepts requests without an Origin header. Clients are native applications, while browsers always
+// send one, so no web page can open a WebSocket to us, even with a token it somehow got hold of.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return r.Header.Get("Origin") == ""
+	},
+}
+
 func (s *Server) newDataHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -48,6 +63,12 @@ func (s *Server) newDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if metadata.TTL < 0 {
+		slog.Error("Negative TTL from request metadata.", "metadata", metadata)
+		http.Error(w, "Invalid ttl in metadata", http.StatusBadRequest)
+		return
+	}
+
 	file, _, err := r.FormFile("blob")
 	if err != nil {
 		slog.Error("Failed to read blob from form.", "userId", userId, "error", err)
@@ -68,12 +89,27 @@ func (s *Server) newDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.DbSvcs.DataService.InsertData(blobData, userId, metadata.Recipient); err != nil {
+	queued, err := s.DbSvcs.DataService.InsertData(blobData, userId, metadata.Recipient, metadata.TTL)
+	if err != nil {
+		if errors.Is(err, data.ErrMailboxFull) {
+			slog.Warn("Recipient mailbox is full.", "userId", userId, "error", err, "metadata", metadata)
+			http.Error(w, "Recipient mailbox is full.", http.StatusInsufficientStorage)
+			return
+		}
+
 		slog.Error("Failure when attempted to insert data.", "userId", userId, "error", err, "metadata", metadata, "blobData", blobData)
 		http.Error(w, "Failed to process data.", http.StatusBadRequest)
 		return
 	}
 
+	// The federated server is unreachable right now, the message will be retried in the background.
+	if queued {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status":"queued"}`))
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"success"}`))
@@ -88,25 +124,37 @@ func (s *Server) dataLongpollHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
 	userId := jwtClaims["user_id"].(string)
-
-	slog.Info("Received data longpoll~!!!")
+	deviceId := authenticate.ClaimsDeviceId(jwtClaims)
 
 	acks := r.URL.Query()["acks"]
-	if len(acks) > 0 {
+	slog.Debug("Received data long-poll.", "userId", userId, "acks", len(acks))
 
-		slog.Info("Received acks, we will start deleting them.", "acks", acks)
-		err := s.DbSvcs.DataService.DeleteAck(userId, acks)
+	if len(acks) > 0 {
+		err := s.DbSvcs.DataService.DeleteAck(userId, deviceId, acks)
 		if err != nil {
 			slog.Error("Error while deleting acknowledged data", "userId", userId, "error", err, "acks", acks)
 			http.Error(w, "Error while processing request.", http.StatusBadRequest)
 			return
 		}
-	} else {
-		slog.Info("No acks provided")
 	}
 
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
+	// Subscribe before the first fetch, so data inserted in between still wakes us up.
+	wakeup, unsubscribe := s.DbSvcs.DataService.Hub.Subscribe(userId)
+	defer unsubscribe()
+
+	dataBlobs, err := s.DbSvcs.DataService.GetLatestData(userId, deviceId)
+	if err != nil {
+		slog.Error("Error while getting latest data", "userId", userId, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusBadRequest)
+		return
+	}
+
+	if dataBlobs != nil {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(dataBlobs)
+		return
+	}
 
 	timeout := time.NewTimer(time.Second * constants.LONGPOLL_MAX)
 	defer timeout.Stop()
@@ -120,11 +168,22 @@ func (s *Server) dataLongpollHandler(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/octet-stream")
 			w.WriteHeader(http.StatusOK)
 			return
-		case <-ticker.C:
+		case <-s.draining:
+			// Same as a timeout, the client simply polls again, on another instance or once we are back.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.WriteHeader(http.StatusOK)
+			return
+		case <-wakeup:
 			if ctx.Err() != nil {
 				return
 			}
-			dataBlobs, err := s.DbSvcs.DataService.GetLatestData(userId)
+
+			if s.tokenRevoked(jwtClaims) {
+				http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+
+			dataBlobs, err := s.DbSvcs.DataService.GetLatestData(userId, deviceId)
 			if err != nil {
 				slog.Error("Error while getting latest data", "userId", userId, "error", err)
 				http.Error(w, "Error while processing request.", http.StatusBadRequest)
@@ -140,3 +199,340 @@ func (s *Server) dataLongpollHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// dataWebsocketHandler streams every stored blob as its own binary message, framed exactly like the long-poll,
+// and accepts `{"acks": [...]}` text messages to delete acknowledged blobs.
+func (s *Server) dataWebsocketHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+	deviceId := authenticate.ClaimsDeviceId(jwtClaims)
+
+	// Subscribe before the first fetch, so data inserted in between still wakes us up.
+	wakeup, unsubscribe := s.DbSvcs.DataService.Hub.Subscribe(userId)
+	defer unsubscribe()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade already replied to the client with an error.
+		slog.Error("Error while upgrading to websocket", "userId", userId, "error", err)
+		return
+	}
+	defer conn.Close()
+
+	slog.Info("Websocket connected", "userId", userId)
+
+	readerDone := make(chan struct{})
+	go s.readWebsocketAcks(conn, userId, deviceId, readerDone)
+
+	pingTicker := time.NewTicker(time.Second * constants.WEBSOCKET_PING_INTERVAL)
+	defer pingTicker.Stop()
+
+	// Ack IDs of blobs we already sent, so a wakeup only sends blobs that are new to this client.
+	sent, err := s.sendPendingBlobs(conn, userId, deviceId, nil)
+	if err != nil {
+		slog.Error("Error while sending data over websocket", "userId", userId, "error", err)
+		return
+	}
+
+	for {
+		select {
+		case <-readerDone:
+			return
+		case <-s.draining:
+			deadline := time.Now().Add(time.Second * constants.WEBSOCKET_WRITE_WAIT)
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server shutting down"), deadline)
+			return
+		case <-wakeup:
+			if s.tokenRevoked(jwtClaims) {
+				closeRevokedWebsocket(conn)
+				return
+			}
+
+			sent, err = s.sendPendingBlobs(conn, userId, deviceId, sent)
+			if err != nil {
+				slog.Error("Error while sending data over websocket", "userId", userId, "error", err)
+				return
+			}
+		case <-pingTicker.C:
+			if s.tokenRevoked(jwtClaims) {
+				closeRevokedWebsocket(conn)
+				return
+			}
+
+			deadline := time.Now().Add(time.Second * constants.WEBSOCKET_WRITE_WAIT)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// closeRevokedWebsocket tells the client its token is no longer accepted, it must reconnect with a new one.
+func closeRevokedWebsocket(conn *websocket.Conn) {
+	deadline := time.Now().Add(time.Second * constants.WEBSOCKET_WRITE_WAIT)
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Token revoked"), deadline)
+}
+
+// tokenRevoked reports whether the token a long-poll or stream was opened with is no longer accepted, because it
+// expired, was revoked, or its user or device is gone. Storage failures count as revoked, the client retries.
+func (s *Server) tokenRevoked(claims jwt.MapClaims) bool {
+	err := s.DbSvcs.UserService.RecheckToken(claims)
+	if errors.Is(err, authenticate.ErrInvalidToken) {
+		slog.Info("Token is no longer valid, ending delivery.", "userId", claims["user_id"], "error", err)
+		return true
+	}
+	if err != nil {
+		slog.Error("Error while checking token revocation", "error", err)
+		return true
+	}
+	return false
+}
+
+// sendPendingBlobs writes every stored blob whose ack ID is not in sent, and returns the ack IDs still pending.
+func (s *Server) sendPendingBlobs(conn *websocket.Conn, userId string, deviceId string, sent map[string]struct{}) (map[string]struct{}, error) {
+	blobs, pending, err := s.unsentBlobs(userId, deviceId, sent)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, blob := range blobs {
+		conn.SetWriteDeadline(time.Now().Add(time.Second * constants.WEBSOCKET_WRITE_WAIT))
+		if err := conn.WriteMessage(websocket.BinaryMessage, blob); err != nil {
+			return nil, err
+		}
+	}
+
+	return pending, nil
+}
+
+// unsentBlobs returns the stored blobs whose ack ID is not in sent, along with the ack IDs of every pending blob.
+// Blobs acknowledged since sent was built are thereby forgotten.
+func (s *Server) unsentBlobs(userId string, deviceId string, sent map[string]struct{}) ([][]byte, map[string]struct{}, error) {
+	dataBlobs, err := s.DbSvcs.DataService.GetLatestData(userId, deviceId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blobs, err := data.SplitDataBlobs(dataBlobs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unsent [][]byte
+	pending := make(map[string]struct{}, len(blobs))
+	for _, blob := range blobs {
+		ackId := string(blob[:constants.ACK_ID_LEN])
+		pending[ackId] = struct{}{}
+
+		if _, ok := sent[ackId]; !ok {
+			unsent = append(unsent, blob)
+		}
+	}
+
+	return unsent, pending, nil
+}
+
+func (s *Server) readWebsocketAcks(conn *websocket.Conn, userId string, deviceId string, done chan<- struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(constants.WEBSOCKET_MAX_MESSAGE_BYTES)
+	conn.SetReadDeadline(time.Now().Add(time.Second * constants.WEBSOCKET_PONG_WAIT))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(time.Second * constants.WEBSOCKET_PONG_WAIT))
+	})
+
+	for {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			slog.Info("Websocket disconnected", "userId", userId, "error", err)
+			return
+		}
+
+		if messageType != websocket.TextMessage {
+			slog.Error("Unexpected websocket message type", "userId", userId, "messageType", messageType)
+			return
+		}
+
+		var payload types.DataAckRequest
+		if err := json.Unmarshal(message, &payload); err != nil {
+			slog.Error("Error while parsing websocket ack JSON.", "userId", userId, "error", err)
+			return
+		}
+
+		if len(payload.Acks) == 0 {
+			continue
+		}
+
+		slog.Debug("Received acks.", "userId", userId, "acks", len(payload.Acks))
+		if err := s.DbSvcs.DataService.DeleteAck(userId, deviceId, payload.Acks); err != nil {
+			slog.Error("Error while deleting acknowledged data", "userId", userId, "error", err, "acks", payload.Acks)
+			return
+		}
+	}
+}
+
+// dataStreamHandler streams every stored blob as a Server-Sent Event, whose data is the base64 of the
+// ack ID followed by the length-prefixed blob, exactly as the long-poll returns it.
+// On SQL backends event IDs are the blob row IDs, so a reconnecting client resumes after its Last-Event-ID.
+func (s *Server) dataStreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+	deviceId := authenticate.ClaimsDeviceId(jwtClaims)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = r.URL.Query().Get("last_event_id")
+	}
+
+	var afterId int64
+	if lastEventId != "" {
+		var err error
+		afterId, err = strconv.ParseInt(lastEventId, 10, 64)
+		if err != nil || afterId < 0 {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Subscribe before the first fetch, so data inserted in between still wakes us up.
+	wakeup, unsubscribe := s.DbSvcs.DataService.Hub.Subscribe(userId)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	slog.Info("Stream connected", "userId", userId, "lastEventId", lastEventId)
+
+	keepalive := time.NewTicker(time.Second * constants.SSE_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	// Only used by backends without row IDs, same as the websocket.
+	var sent map[string]struct{}
+
+	afterId, sent, err := s.writeStreamEvents(w, userId, deviceId, afterId, sent)
+	if err != nil {
+		slog.Error("Error while streaming data", "userId", userId, "error", err)
+		return
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.draining:
+			// The client reconnects with its Last-Event-ID.
+			return
+		case <-wakeup:
+			// The client's reconnection is then refused until it presents a valid token.
+			if s.tokenRevoked(jwtClaims) {
+				return
+			}
+
+			afterId, sent, err = s.writeStreamEvents(w, userId, deviceId, afterId, sent)
+			if err != nil {
+				slog.Error("Error while streaming data", "userId", userId, "error", err)
+				return
+			}
+		case <-keepalive.C:
+			if s.tokenRevoked(jwtClaims) {
+				return
+			}
+
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeStreamEvents writes an event for every blob newer than afterId, or not in sent for backends without row IDs,
+// and returns the updated afterId and sent.
+func (s *Server) writeStreamEvents(w io.Writer, userId string, deviceId string, afterId int64, sent map[string]struct{}) (int64, map[string]struct{}, error) {
+	records, ok, err := s.DbSvcs.DataService.GetDataSince(userId, deviceId, afterId)
+	if err != nil {
+		return afterId, sent, err
+	}
+
+	if ok {
+		for _, record := range records {
+			event := append(record.AckId, record.Blob...)
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", record.Id, base64.StdEncoding.EncodeToString(event)); err != nil {
+				return afterId, sent, err
+			}
+			afterId = record.Id
+		}
+		return afterId, sent, nil
+	}
+
+	blobs, pending, err := s.unsentBlobs(userId, deviceId, sent)
+	if err != nil {
+		return afterId, sent, err
+	}
+
+	for _, blob := range blobs {
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", base64.StdEncoding.EncodeToString(blob)); err != nil {
+			return afterId, sent, err
+		}
+	}
+
+	return afterId, pending, nil
+}
+
+// dataAckHandler deletes acknowledged blobs, for clients that receive them over /data/stream.
+func (s *Server) dataAckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+	deviceId := authenticate.ClaimsDeviceId(jwtClaims)
+
+	var payload types.DataAckRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if len(payload.Acks) == 0 {
+		http.Error(w, "Missing acks", http.StatusBadRequest)
+		return
+	}
+
+	slog.Debug("Received acks.", "userId", userId, "acks", len(payload.Acks))
+	if err := s.DbSvcs.DataService.DeleteAck(userId, deviceId, payload.Acks); err != nil {
+		slog.Error("Error while deleting acknowledged data", "userId", userId, "error", err, "acks", payload.Acks)
+		http.Error(w, "Error while processing request.", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"success"}`))
+}
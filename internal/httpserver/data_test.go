@@ -0,0 +1,233 @@
+package httpserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/notify"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/sqlite"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// streamTestUserId is the user the data delivery handlers are served as by newStreamTestServer.
+const streamTestUserId = "1111111111111111"
+
+// newStreamTestServer serves the data delivery handlers as a user with an empty mailbox, with claims of a valid
+// access token but without verifying any token.
+func newStreamTestServer(t *testing.T) (*Server, *httptest.Server, *sqlite.SQLiteStorage) {
+	store, err := sqlite.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveUser(streamTestUserId, []byte("public key")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{}
+	s := &Server{Cfg: cfg, draining: make(chan struct{}), DbSvcs: &DBServices{
+		UserService: &authenticate.UserService{Store: store, Cfg: cfg},
+		DataService: &data.DataService{Store: store, Cfg: cfg, Hub: notify.NewHub()},
+	}}
+
+	issuedAt := time.Now().Unix() - 1
+	asUser := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			claims := jwt.MapClaims{"user_id": streamTestUserId, "jti": "test", "iat": float64(issuedAt), "exp": float64(issuedAt + 3600)}
+			handler(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/data/longpoll", asUser(s.dataLongpollHandler))
+	mux.Handle("/data/ws", asUser(s.dataWebsocketHandler))
+	mux.Handle("/data/stream", asUser(s.dataStreamHandler))
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return s, srv, store
+}
+
+// revokeStreamTestUser revokes every token of the test user, and wakes up its long-polls and streams.
+func revokeStreamTestUser(t *testing.T, s *Server, store *sqlite.SQLiteStorage) {
+	if err := store.RevokeUserTokens(streamTestUserId, time.Now().UnixMilli()+1); err != nil {
+		t.Fatal(err)
+	}
+	s.DbSvcs.DataService.Hub.Notify(streamTestUserId)
+}
+
+func TestShutdownDrainsLongpoll(t *testing.T) {
+	s, srv, _ := newStreamTestServer(t)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/data/longpoll")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+
+	// Give the long-poll time to start waiting for data.
+	time.Sleep(100 * time.Millisecond)
+	close(s.draining)
+
+	select {
+	case resp := <-done:
+		if resp == nil {
+			return
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK || len(body) != 0 {
+			t.Fatalf("expected an empty 200, got %d with %d bytes: %v", resp.StatusCode, len(body), err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("long-poll kept waiting after shutdown")
+	}
+}
+
+func TestShutdownClosesWebsocket(t *testing.T) {
+	s, srv, _ := newStreamTestServer(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/data/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	close(s.draining)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected a going away close frame, got %v", err)
+	}
+}
+
+func TestShutdownEndsStream(t *testing.T) {
+	s, srv, _ := newStreamTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/data/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	close(s.draining)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("stream did not end cleanly: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream kept running after shutdown")
+	}
+}
+
+func TestWebsocketRejectsBrowserOrigins(t *testing.T) {
+	_, srv, _ := newStreamTestServer(t)
+
+	header := http.Header{"Origin": {"https://example.com"}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/data/ws", header)
+	if err == nil {
+		conn.Close()
+		t.Fatal("upgrade request with an Origin header was accepted")
+	}
+
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected status 403, got %v", err)
+	}
+}
+
+func TestRevokedTokenEndsLongpoll(t *testing.T) {
+	s, srv, store := newStreamTestServer(t)
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(srv.URL + "/data/longpoll")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+
+	// Give the long-poll time to start waiting for data.
+	time.Sleep(100 * time.Millisecond)
+	revokeStreamTestUser(t, s, store)
+
+	select {
+	case resp := <-done:
+		if resp == nil {
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status 401 once the token is revoked, got %d", resp.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("long-poll kept waiting with a revoked token")
+	}
+}
+
+func TestRevokedTokenClosesWebsocket(t *testing.T) {
+	s, srv, store := newStreamTestServer(t)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/data/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	revokeStreamTestUser(t, s, store)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected a policy violation close frame, got %v", err)
+	}
+}
+
+func TestRevokedTokenEndsStream(t *testing.T) {
+	s, srv, store := newStreamTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/data/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	revokeStreamTestUser(t, s, store)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("stream did not end cleanly: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream kept running with a revoked token")
+	}
+}
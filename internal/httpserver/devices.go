@@ -0,0 +1,165 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// requirePrimaryDevice replies with 403 and returns false if the token is bound to an additional device.
+// Only the primary device manages the account, so a compromised additional device can't lock the user out.
+func requirePrimaryDevice(w http.ResponseWriter, jwtClaims jwt.MapClaims) bool {
+	if authenticate.ClaimsDeviceId(jwtClaims) != constants.PRIMARY_DEVICE_ID {
+		http.Error(w, "Only the primary device can do this", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (s *Server) devicesListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+
+	devices, err := s.DbSvcs.UserService.ListDevices(userId)
+	if err != nil {
+		slog.Error("Error while listing devices.", "user_id", userId, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+		return
+	}
+
+	resp := types.DeviceListResponse{Devices: make([]types.DeviceInfo, len(devices))}
+	for i, device := range devices {
+		sum := sha256.Sum256(device.PublicKey)
+		resp.Devices[i] = types.DeviceInfo{
+			DeviceID:    device.Id,
+			Fingerprint: hex.EncodeToString(sum[:]),
+			CreatedAt:   device.CreatedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Error while encoding response.", "error", err)
+	}
+}
+
+// devicesAddHandler registers a new device for the user, proven by the new device's signature over a challenge
+// issued for its public-key. The new device then authenticates with the user ID and the returned device ID.
+func (s *Server) devicesAddHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+
+	if !requirePrimaryDevice(w, jwtClaims) {
+		return
+	}
+
+	var payload types.DeviceAddRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if payload.Signature == "" || payload.Challenge == "" {
+		http.Error(w, "Request missing signature or challenge fields", http.StatusBadRequest)
+		return
+	}
+
+	deviceId, err := s.DbSvcs.UserService.AddDevice(userId, &payload)
+	if err != nil {
+		switch {
+		case errors.Is(err, authenticate.ErrInvalidDevice):
+			slog.Warn("Device verification failed!", "user_id", userId, "error", err)
+			http.Error(w, "Invalid device", http.StatusUnauthorized)
+		case errors.Is(err, authenticate.ErrTooManyDevices):
+			http.Error(w, "Too many devices", http.StatusConflict)
+		default:
+			slog.Error("Error while adding device.", "user_id", userId, "error", err)
+			http.Error(w, "Error while processing request.", http.StatusBadRequest)
+		}
+		return
+	}
+
+	slog.Info("Added device", "user_id", userId, "device_id", deviceId)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(types.DeviceAddResponse{DeviceID: deviceId}); err != nil {
+		slog.Error("Error while encoding response.", "error", err)
+	}
+}
+
+// devicesRemoveHandler removes one of the user's additional devices, along with its tokens and delivery state.
+func (s *Server) devicesRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	jwtClaims := ctx.Value(claimsKey).(jwt.MapClaims)
+	userId := jwtClaims["user_id"].(string)
+
+	if !requirePrimaryDevice(w, jwtClaims) {
+		return
+	}
+
+	var payload types.DeviceRemoveRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if payload.DeviceID == "" {
+		http.Error(w, "Request missing device_id field", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := s.DbSvcs.UserService.RemoveDevice(userId, payload.DeviceID)
+	if errors.Is(err, authenticate.ErrInvalidDevice) {
+		http.Error(w, "The primary device can't be removed", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("Error while removing device.", "user_id", userId, "device_id", payload.DeviceID, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		http.Error(w, "Device does not exist", http.StatusNotFound)
+		return
+	}
+
+	// Blobs only the removed device had left to acknowledge would otherwise never be deleted.
+	if err := s.DbSvcs.DataService.RemoveDeviceAcks(userId, payload.DeviceID); err != nil {
+		slog.Error("Device removed, but forgetting its acknowledgements failed.", "user_id", userId, "device_id", payload.DeviceID, "error", err)
+		http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("Removed device", "user_id", userId, "device_id", payload.DeviceID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"success"}`))
+}
@@ -2,12 +2,17 @@ package httpserver
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"time"
 
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/metrics"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
 	"github.com/cloudflare/circl/sign/mldsa/mldsa87"
@@ -51,9 +56,10 @@ func (s *Server) federationInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := types.FederationInfoResponse{
-		Signature:   signature,
-		PublicKey:   ourPublicKeyEncoded,
-		RefetchDate: refetchDate,
+		Signature:    signature,
+		PublicKey:    ourPublicKeyEncoded,
+		RefetchDate:  refetchDate,
+		KeyRotations: s.activeKeyRotations(time.Now().Unix()),
 	}
 
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -62,6 +68,64 @@ func (s *Server) federationInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// keyRotation is a signed rotation away from one of our previous keys, served until the key retires.
+type keyRotation struct {
+	types.FederationKeyRotation
+	retiresAt int64
+}
+
+// signKeyRotations signs, with each previous key that hasn't retired yet, its rotation to the key that replaced it,
+// so that federated servers which pinned it can follow us to our current key.
+func signKeyRotations(cfg *config.Config, now int64) ([]keyRotation, error) {
+	var rotations []keyRotation
+	for _, previous := range cfg.DSAPreviousKeys {
+		if previous.Retired(now) {
+			continue
+		}
+
+		previousPrivateKey, err := crypto.PrivateKeyFromBytes(previous.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		previousPublicKey, err := previousPrivateKey.Public().(*mldsa87.PublicKey).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		signature, err := crypto.SignKeyRotation(previousPrivateKey, cfg.DomainOrIP, previousPublicKey, previous.ReplacedBy)
+		if err != nil {
+			return nil, err
+		}
+
+		rotations = append(rotations, keyRotation{
+			FederationKeyRotation: types.FederationKeyRotation{
+				PreviousPublicKey: previousPublicKey,
+				PublicKey:         previous.ReplacedBy,
+				Signature:         signature,
+			},
+			retiresAt: previous.RetiresAt,
+		})
+	}
+
+	return rotations, nil
+}
+
+// activeKeyRotations returns the signed rotations of previous keys that haven't retired at now.
+func (s *Server) activeKeyRotations(now int64) []types.FederationKeyRotation {
+	var rotations []types.FederationKeyRotation
+	for _, rotation := range s.keyRotations {
+		if rotation.retiresAt > now {
+			rotations = append(rotations, rotation.FederationKeyRotation)
+		}
+	}
+	return rotations
+}
+
+// unverifiedHost labels federation metrics of requests whose signature wasn't verified, so that
+// forged urls can't create an unbounded number of metric series.
+const unverifiedHost = "unknown"
+
 func (s *Server) federationSendHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -110,6 +174,13 @@ func (s *Server) federationSendHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Older servers send neither, FederationProcessor decides whether they are still accepted.
+	if (metadata.MessageId == "") != (metadata.Timestamp == 0) {
+		slog.Error("Missing message ID or timestamp from request metadata.", "metadata", metadata)
+		http.Error(w, "Missing message_id or timestamp in metadata", http.StatusBadRequest)
+		return
+	}
+
 	if !utils.IsAllDigits(metadata.Sender) {
 		slog.Error("Malformed sender id from request metadata.", "sender", metadata.Sender)
 		http.Error(w, "Malformed sender.", http.StatusBadRequest)
@@ -128,6 +199,13 @@ func (s *Server) federationSendHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := s.checkFederationClientCert(r, metadata.Url); err != nil {
+		metrics.FederationReceived.WithLabelValues(unverifiedHost, "rejected").Inc()
+		slog.Warn("Rejected federation peer client certificate.", "url", metadata.Url, "error", err)
+		http.Error(w, "Invalid client certificate.", http.StatusForbidden)
+		return
+	}
+
 	file, _, err := r.FormFile("blob")
 	if err != nil {
 		slog.Error("Error while reading blob file.", "error", err)
@@ -149,10 +227,59 @@ func (s *Server) federationSendHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.DbSvcs.DataService.FederationProcessor(metadata.Sender, metadata.Recipient, metadata.Url, blobData); err != nil {
-		slog.Error("Failure when attempted to process federation request.", "sender", metadata.Sender, "recipient", "url", metadata.Url, metadata.Recipient, "error", err)
+	if err := s.DbSvcs.DataService.FederationProcessor(metadata, blobData); err != nil {
+		if errors.Is(err, data.ErrFederationReplay) {
+			metrics.FederationReceived.WithLabelValues(metadata.Url, "replayed").Inc()
+			slog.Warn("Dropped replayed federation message.", "sender", metadata.Sender, "recipient", metadata.Recipient, "url", metadata.Url, "message_id", metadata.MessageId)
+			http.Error(w, "Message was already received.", http.StatusConflict)
+			return
+		}
+
+		if errors.Is(err, data.ErrMailboxFull) {
+			metrics.FederationReceived.WithLabelValues(metadata.Url, "mailbox_full").Inc()
+			slog.Warn("Recipient mailbox is full.", "sender", metadata.Sender, "recipient", metadata.Recipient, "url", metadata.Url, "error", err)
+			http.Error(w, "Recipient mailbox is full.", http.StatusInsufficientStorage)
+			return
+		}
+
+		if errors.Is(err, data.ErrFederationUnavailable) {
+			metrics.FederationReceived.WithLabelValues(unverifiedHost, "failed").Inc()
+			slog.Error("Could not process federation request, the sender will retry it.", "sender", metadata.Sender, "recipient", metadata.Recipient, "url", metadata.Url, "error", err)
+			http.Error(w, "Failed to process data, try again later.", http.StatusServiceUnavailable)
+			return
+		}
+
+		if errors.Is(err, data.ErrLegacyFederation) {
+			metrics.FederationReceived.WithLabelValues(unverifiedHost, "rejected").Inc()
+			slog.Warn("Rejected federation message from a server running an older version.", "sender", metadata.Sender, "recipient", metadata.Recipient, "url", metadata.Url)
+			http.Error(w, "Missing message_id and timestamp in metadata, the sending server must be upgraded.", http.StatusBadRequest)
+			return
+		}
+
+		metrics.FederationReceived.WithLabelValues(unverifiedHost, "rejected").Inc()
+		slog.Error("Failure when attempted to process federation request.", "sender", metadata.Sender, "recipient", metadata.Recipient, "url", metadata.Url, "error", err)
 		http.Error(w, "Failed to process data.", http.StatusBadRequest)
 		return
 	}
 
+	metrics.FederationReceived.WithLabelValues(metadata.Url, "accepted").Inc()
+}
+
+// checkFederationClientCert makes sure a verified client certificate, if any, was issued to the server
+// the request claims to come from. Requests without one are only rejected when client certificates are required.
+func (s *Server) checkFederationClientCert(r *http.Request, url string) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		if s.Cfg.TLS.RequireFederationClientCert {
+			return errors.New("Missing client certificate")
+		}
+		return nil
+	}
+
+	// Peers on a non-default port are addressed as host:port, certificates only name the host.
+	host, _, err := net.SplitHostPort(url)
+	if err != nil {
+		host = url
+	}
+
+	return r.TLS.VerifiedChains[0][0].VerifyHostname(host)
 }
@@ -0,0 +1,31 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+)
+
+func TestCheckFederationClientCert(t *testing.T) {
+	// httptest's certificate is issued to example.com.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	s := &Server{Cfg: &config.Config{}}
+	r := httptest.NewRequest(http.MethodPost, "/federation/send", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{srv.Certificate()}}}
+
+	for _, url := range []string{"example.com", "example.com:8443"} {
+		if err := s.checkFederationClientCert(r, url); err != nil {
+			t.Fatalf("certificate of %s rejected: %v", url, err)
+		}
+	}
+
+	if err := s.checkFederationClientCert(r, "other.example.org:8443"); err == nil {
+		t.Fatal("certificate accepted for another server")
+	}
+}
@@ -0,0 +1,84 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/types"
+)
+
+// healthzHandler answers as long as the process is serving requests.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, types.HealthResponse{Status: "ok"})
+}
+
+// readyzHandler pings both storages, and answers 503 if either is unusable or the server is shutting down.
+func (s *Server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*constants.HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+
+	resp := types.ReadinessResponse{
+		Status:      "ready",
+		UserStorage: checkStorage(ctx, s.Cfg.UserStorage, s.DbSvcs.UserService.Store),
+		DataStorage: checkStorage(ctx, s.Cfg.DataStorage, s.DbSvcs.DataService.Store),
+	}
+
+	select {
+	case <-s.draining:
+		resp.Status = "draining"
+	default:
+		if resp.UserStorage.Status != "ok" || resp.DataStorage.Status != "ok" {
+			resp.Status = "unavailable"
+		}
+	}
+
+	code := http.StatusOK
+	if resp.Status != "ready" {
+		slog.Warn("Server is not ready", "status", resp.Status, "userStorage", resp.UserStorage, "dataStorage", resp.DataStorage)
+		code = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, code, resp)
+}
+
+// checkStorage reports store as healthy unless its health check fails, backends without one can't be checked.
+// The error is only logged, /readyz is public and driver errors can name hosts and credentials.
+func checkStorage(ctx context.Context, backend string, store any) types.StorageHealth {
+	health := types.StorageHealth{Backend: backend, Status: "ok"}
+
+	checker, ok := store.(storage.HealthChecker)
+	if !ok {
+		return health
+	}
+
+	if err := checker.HealthCheck(ctx); err != nil {
+		slog.Error("Storage health check failed", "backend", backend, "error", err)
+		health.Status = "error"
+	}
+
+	return health
+}
+
+func writeJSON(w http.ResponseWriter, code int, resp any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Error while encoding response.", "resp", resp, "error", err)
+	}
+}
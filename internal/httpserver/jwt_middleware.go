@@ -2,10 +2,12 @@ package httpserver
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"strings"
 
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/crypto"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
 )
 
 type ctxKey string
@@ -27,11 +29,16 @@ func (s *Server) jwtMiddleware(next http.Handler) http.Handler {
 		}
 		tokenString := parts[1]
 
-		token, claims, err := crypto.VerifyJWT(tokenString, s.Cfg.JWTSecret)
-		if err != nil || !token.Valid {
+		claims, err := s.DbSvcs.UserService.ValidateToken(tokenString, authenticate.AccessToken)
+		if errors.Is(err, authenticate.ErrInvalidToken) {
 			http.Error(w, "invalid or expired token", http.StatusUnauthorized)
 			return
 		}
+		if err != nil {
+			slog.Error("Error while checking token revocation", "error", err)
+			http.Error(w, "Error while processing request.", http.StatusInternalServerError)
+			return
+		}
 
 		// Attach claims to context
 		ctx := context.WithValue(r.Context(), claimsKey, claims)
@@ -1,22 +1,33 @@
 package httpserver
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"mime"
 	"net/http"
 	"path/filepath"
+	"time"
 
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/authenticate"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/certs"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
 	"github.com/Freedom-Club-Sec/Coldwire-server/internal/data"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/metrics"
 )
 
 type Server struct {
-	addr   string
-	mux    *http.ServeMux
-	Cfg    *config.Config
-	DbSvcs *DBServices
+	addr       string
+	mux        *http.ServeMux
+	httpServer *http.Server
+	Cfg        *config.Config
+	DbSvcs     *DBServices
+
+	// Closed once Shutdown is called, so long-polls and streams return early.
+	draining chan struct{}
+
+	// Signed once at startup, served by /federation/info until each one retires.
+	keyRotations []keyRotation
 }
 
 type DBServices struct {
@@ -28,16 +39,36 @@ type DBServices struct {
 var webFiles embed.FS
 
 func (s *Server) registerRoutes() {
-	s.mux.HandleFunc("/authenticate/init", s.authenticateInitHandler)
-	s.mux.HandleFunc("/authenticate/verify", s.authenticateVerificationHandler)
+	s.handle("/authenticate/init", http.HandlerFunc(s.authenticateInitHandler))
+	s.handle("/authenticate/verify", http.HandlerFunc(s.authenticateVerificationHandler))
+	s.handle("/authenticate/refresh", http.HandlerFunc(s.authenticateRefreshHandler))
+	s.handle("/authenticate/rotate-key", http.HandlerFunc(s.authenticateRotateKeyHandler))
+	s.handle("/authenticate/revoke", s.jwtMiddleware(http.HandlerFunc(s.authenticateRevokeHandler)))
+
+	s.handle("/account/delete", s.jwtMiddleware(http.HandlerFunc(s.accountDeleteHandler)))
+
+	s.handle("/devices/list", s.jwtMiddleware(http.HandlerFunc(s.devicesListHandler)))
+	s.handle("/devices/add", s.jwtMiddleware(http.HandlerFunc(s.devicesAddHandler)))
+	s.handle("/devices/remove", s.jwtMiddleware(http.HandlerFunc(s.devicesRemoveHandler)))
 
-	s.mux.Handle("/data/longpoll", s.jwtMiddleware(http.HandlerFunc(s.dataLongpollHandler)))
-	s.mux.Handle("/data/send", s.jwtMiddleware(http.HandlerFunc(s.newDataHandler)))
+	s.handle("/data/longpoll", s.jwtMiddleware(http.HandlerFunc(s.dataLongpollHandler)))
+	s.handle("/data/send", s.jwtMiddleware(http.HandlerFunc(s.newDataHandler)))
+	s.handle("/data/ws", s.jwtMiddleware(http.HandlerFunc(s.dataWebsocketHandler)))
+	s.handle("/data/stream", s.jwtMiddleware(http.HandlerFunc(s.dataStreamHandler)))
+	s.handle("/data/ack", s.jwtMiddleware(http.HandlerFunc(s.dataAckHandler)))
 
-	s.mux.HandleFunc("/federation/info", s.federationInfoHandler)
-	s.mux.HandleFunc("/federation/send", s.federationSendHandler)
+	s.handle("/federation/info", http.HandlerFunc(s.federationInfoHandler))
+	s.handle("/federation/send", http.HandlerFunc(s.federationSendHandler))
 
-	s.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	s.handle("/healthz", http.HandlerFunc(s.healthzHandler))
+	s.handle("/readyz", http.HandlerFunc(s.readyzHandler))
+
+	// Served on its own listener instead when Metrics.Listen_address is set.
+	if s.Cfg.Metrics.Enabled && s.Cfg.Metrics.ListenAddress == "" {
+		s.mux.Handle("/metrics", metrics.Handler())
+	}
+
+	s.handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		path := r.URL.Path
 		if path == "/" {
 			path = "/index.html"
@@ -58,26 +89,56 @@ func (s *Server) registerRoutes() {
 		}
 
 		w.Write(data)
-	})
+	}))
+
+}
 
+// handle registers handler for pattern, counting and timing its requests under the pattern's name.
+func (s *Server) handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, metrics.InstrumentHandler(pattern, handler))
 }
 
-func New(host string, port int, cfg *config.Config, dbSvcs *DBServices) *Server {
+func New(host string, port int, cfg *config.Config, dbSvcs *DBServices) (*Server, error) {
+	keyRotations, err := signKeyRotations(cfg, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
 	mux := http.NewServeMux()
 
 	srv := &Server{
-		addr:   fmt.Sprintf("%s:%d", host, port),
-		mux:    mux,
-		Cfg:    cfg,
-		DbSvcs: dbSvcs,
+		addr:         fmt.Sprintf("%s:%d", host, port),
+		mux:          mux,
+		Cfg:          cfg,
+		DbSvcs:       dbSvcs,
+		draining:     make(chan struct{}),
+		keyRotations: keyRotations,
 	}
+	srv.httpServer = &http.Server{Addr: srv.addr, Handler: mux}
 	srv.registerRoutes()
 
-	return srv
+	return srv, nil
+}
+
+// EnableTLS makes Start serve HTTPS with the reloader's certificates.
+func (s *Server) EnableTLS(reloader *certs.Reloader) {
+	s.httpServer.TLSConfig = reloader.ServerConfig()
 }
 
+// Start serves until Shutdown is called, in which case it returns http.ErrServerClosed.
 func (s *Server) Start() error {
-	return http.ListenAndServe(s.addr, s.mux)
+	if s.httpServer.TLSConfig != nil {
+		// Certificates come from the TLS config, so they can be reloaded.
+		return s.httpServer.ListenAndServeTLS("", "")
+	}
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown stops accepting connections, makes waiting long-polls return empty and closes streams,
+// then waits until ctx is done for in-flight requests to finish.
+func (s *Server) Shutdown(ctx context.Context) error {
+	close(s.draining)
+	return s.httpServer.Shutdown(ctx)
 }
 
 func (s *Server) Addr() string {
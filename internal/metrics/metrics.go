@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every Coldwire metric, along with the Go runtime and process collectors.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+// Buckets up to a full long-poll wait, see LONGPOLL_MAX.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 20, 30, 60}
+
+var (
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "coldwire_http_requests_total",
+		Help: "HTTP requests by handler and status code.",
+	}, []string{"handler", "code"})
+
+	HTTPDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "coldwire_http_request_duration_seconds",
+		Help:    "HTTP request duration by handler, including the time long-polls spend waiting.",
+		Buckets: durationBuckets,
+	}, []string{"handler"})
+
+	StorageDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "coldwire_storage_call_duration_seconds",
+		Help:    "Storage call latency by backend and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend", "method"})
+
+	StorageErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "coldwire_storage_call_errors_total",
+		Help: "Storage calls that returned an error, by backend and method.",
+	}, []string{"backend", "method"})
+
+	FederationSent = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "coldwire_federation_sent_total",
+		Help: "Federation messages sent by remote host and result (delivered, queued, rejected, failed).",
+	}, []string{"host", "result"})
+
+	FederationReceived = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "coldwire_federation_received_total",
+		Help: "Federation messages received by remote host and result (accepted, rejected, failed, replayed, mailbox_full), rejected and failed ones are all counted under the \"unknown\" host.",
+	}, []string{"host", "result"})
+
+	AuthAttempts = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "coldwire_auth_attempts_total",
+		Help: "Authentication attempts by method (verify, refresh, rotate_key) and result (success, failure).",
+	}, []string{"method", "result"})
+
+	DataInserted = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "coldwire_data_inserted_bytes_total",
+		Help: "Bytes of data stored for local recipients, by backend.",
+	}, []string{"backend"})
+
+	QueuedBytes = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "coldwire_data_queued_bytes",
+		Help: "Bytes of undelivered data in storage by backend, refreshed by the data janitor.",
+	}, []string{"backend"})
+
+	QueuedMessages = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "coldwire_data_queued_messages",
+		Help: "Undelivered messages in storage by backend, refreshed by the data janitor.",
+	}, []string{"backend"})
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// NewServer returns a server exposing only /metrics on addr, for scraping from a private network.
+func NewServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// InstrumentHandler counts requests and observes their duration under the given handler label.
+func InstrumentHandler(name string, next http.Handler) http.Handler {
+	labels := prometheus.Labels{"handler": name}
+
+	return promhttp.InstrumentHandlerCounter(HTTPRequests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(HTTPDuration.MustCurryWith(labels), next))
+}
+
+// ObserveStorage records the latency and failure of a storage call started at start.
+func ObserveStorage(backend string, method string, start time.Time, err error) {
+	StorageDuration.WithLabelValues(backend, method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		StorageErrors.WithLabelValues(backend, method).Inc()
+	}
+}
@@ -0,0 +1,272 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+)
+
+// storageObserver records the calls made to one storage backend.
+type storageObserver struct {
+	backend string
+}
+
+func (o storageObserver) observe(method string, start time.Time, err *error) {
+	ObserveStorage(o.backend, method, start, *err)
+}
+
+// healthCheck forwards to s if it is a storage.HealthChecker, backends without one are assumed healthy.
+func (o storageObserver) healthCheck(ctx context.Context, s any) (err error) {
+	checker, ok := s.(storage.HealthChecker)
+	if !ok {
+		return nil
+	}
+
+	defer o.observe("HealthCheck", time.Now(), &err)
+	return checker.HealthCheck(ctx)
+}
+
+type userStorage struct {
+	storage.UserStorage
+	storageObserver
+}
+
+// NewUserStorage wraps s so that the latency and errors of its calls are recorded under the backend label.
+func NewUserStorage(backend string, s storage.UserStorage) storage.UserStorage {
+	return &userStorage{UserStorage: s, storageObserver: storageObserver{backend}}
+}
+
+func (s *userStorage) SaveUser(id string, publicKey []byte) (err error) {
+	defer s.observe("SaveUser", time.Now(), &err)
+	return s.UserStorage.SaveUser(id, publicKey)
+}
+
+func (s *userStorage) UpdateUserPublicKey(id string, oldPublicKey []byte, newPublicKey []byte) (updated bool, err error) {
+	defer s.observe("UpdateUserPublicKey", time.Now(), &err)
+	return s.UserStorage.UpdateUserPublicKey(id, oldPublicKey, newPublicKey)
+}
+
+func (s *userStorage) CheckUserIdExists(id string) (exists bool, err error) {
+	defer s.observe("CheckUserIdExists", time.Now(), &err)
+	return s.UserStorage.CheckUserIdExists(id)
+}
+
+func (s *userStorage) GetUserPublicKeyById(id string) (publicKey []byte, err error) {
+	defer s.observe("GetUserPublicKeyById", time.Now(), &err)
+	return s.UserStorage.GetUserPublicKeyById(id)
+}
+
+func (s *userStorage) SaveChallenge(challenge []byte, id interface{}, publicKey interface{}, createdAt int64, expiresAt int64) (err error) {
+	defer s.observe("SaveChallenge", time.Now(), &err)
+	return s.UserStorage.SaveChallenge(challenge, id, publicKey, createdAt, expiresAt)
+}
+
+func (s *userStorage) SaveServerInfo(url string, publicKey []byte, refetchDate string) (err error) {
+	defer s.observe("SaveServerInfo", time.Now(), &err)
+	return s.UserStorage.SaveServerInfo(url, publicKey, refetchDate)
+}
+
+func (s *userStorage) GetServerInfo(url string) (publicKey []byte, refetchDate string, err error) {
+	defer s.observe("GetServerInfo", time.Now(), &err)
+	return s.UserStorage.GetServerInfo(url)
+}
+
+func (s *userStorage) ConsumeChallenge(challenge []byte, now int64) (publicKey []byte, userId string, err error) {
+	defer s.observe("ConsumeChallenge", time.Now(), &err)
+	return s.UserStorage.ConsumeChallenge(challenge, now)
+}
+
+func (s *userStorage) PurgeExpiredChallenges(now int64) (purged int64, err error) {
+	defer s.observe("PurgeExpiredChallenges", time.Now(), &err)
+	return s.UserStorage.PurgeExpiredChallenges(now)
+}
+
+func (s *userStorage) RevokeToken(jti string, expiresAt int64) (revoked bool, err error) {
+	defer s.observe("RevokeToken", time.Now(), &err)
+	return s.UserStorage.RevokeToken(jti, expiresAt)
+}
+
+func (s *userStorage) RevokeUserTokens(userId string, issuedBefore int64) (err error) {
+	defer s.observe("RevokeUserTokens", time.Now(), &err)
+	return s.UserStorage.RevokeUserTokens(userId, issuedBefore)
+}
+
+func (s *userStorage) IsTokenRevoked(jti string, userId string, issuedAt int64) (revoked bool, err error) {
+	defer s.observe("IsTokenRevoked", time.Now(), &err)
+	return s.UserStorage.IsTokenRevoked(jti, userId, issuedAt)
+}
+
+func (s *userStorage) PurgeExpiredRevocations(now int64) (purged int64, err error) {
+	defer s.observe("PurgeExpiredRevocations", time.Now(), &err)
+	return s.UserStorage.PurgeExpiredRevocations(now)
+}
+
+func (s *userStorage) ListUsers() (ids []string, err error) {
+	defer s.observe("ListUsers", time.Now(), &err)
+	return s.UserStorage.ListUsers()
+}
+
+func (s *userStorage) DeleteUser(id string, reservedUntil int64) (deleted bool, err error) {
+	defer s.observe("DeleteUser", time.Now(), &err)
+	return s.UserStorage.DeleteUser(id, reservedUntil)
+}
+
+func (s *userStorage) IsUserIdReserved(id string, now int64) (reserved bool, err error) {
+	defer s.observe("IsUserIdReserved", time.Now(), &err)
+	return s.UserStorage.IsUserIdReserved(id, now)
+}
+
+func (s *userStorage) PurgeExpiredReservations(now int64) (purged int64, err error) {
+	defer s.observe("PurgeExpiredReservations", time.Now(), &err)
+	return s.UserStorage.PurgeExpiredReservations(now)
+}
+
+func (s *userStorage) SetUserBan(id string, bannedAt int64) (exists bool, err error) {
+	defer s.observe("SetUserBan", time.Now(), &err)
+	return s.UserStorage.SetUserBan(id, bannedAt)
+}
+
+func (s *userStorage) GetUserBan(id string) (bannedAt int64, err error) {
+	defer s.observe("GetUserBan", time.Now(), &err)
+	return s.UserStorage.GetUserBan(id)
+}
+
+func (s *userStorage) ListServers() (servers []storage.ServerInfo, err error) {
+	defer s.observe("ListServers", time.Now(), &err)
+	return s.UserStorage.ListServers()
+}
+
+func (s *userStorage) DeleteServerInfo(url string) (deleted bool, err error) {
+	defer s.observe("DeleteServerInfo", time.Now(), &err)
+	return s.UserStorage.DeleteServerInfo(url)
+}
+
+func (s *userStorage) AddDevice(userId string, deviceId string, publicKey []byte, createdAt int64) (err error) {
+	defer s.observe("AddDevice", time.Now(), &err)
+	return s.UserStorage.AddDevice(userId, deviceId, publicKey, createdAt)
+}
+
+func (s *userStorage) GetDevicePublicKey(userId string, deviceId string) (publicKey []byte, err error) {
+	defer s.observe("GetDevicePublicKey", time.Now(), &err)
+	return s.UserStorage.GetDevicePublicKey(userId, deviceId)
+}
+
+func (s *userStorage) ListDevices(userId string) (devices []storage.Device, err error) {
+	defer s.observe("ListDevices", time.Now(), &err)
+	return s.UserStorage.ListDevices(userId)
+}
+
+func (s *userStorage) RemoveDevice(userId string, deviceId string) (removed bool, err error) {
+	defer s.observe("RemoveDevice", time.Now(), &err)
+	return s.UserStorage.RemoveDevice(userId, deviceId)
+}
+
+func (s *userStorage) HealthCheck(ctx context.Context) error {
+	return s.healthCheck(ctx, s.UserStorage)
+}
+
+type dataStorage struct {
+	storage.DataStorage
+	storageObserver
+}
+
+// dataStreamer keeps the storage.DataStreamer implementation of backends that have one visible through the wrapper.
+type dataStreamer struct {
+	*dataStorage
+	streamer storage.DataStreamer
+}
+
+// NewDataStorage wraps s so that the latency and errors of its calls are recorded under the backend label.
+func NewDataStorage(backend string, s storage.DataStorage) storage.DataStorage {
+	wrapped := &dataStorage{DataStorage: s, storageObserver: storageObserver{backend}}
+
+	if streamer, ok := s.(storage.DataStreamer); ok {
+		return &dataStreamer{dataStorage: wrapped, streamer: streamer}
+	}
+	return wrapped
+}
+
+func (s *dataStorage) GetLatestData(userId string, deviceId string) (data []byte, err error) {
+	defer s.observe("GetLatestData", time.Now(), &err)
+	return s.DataStorage.GetLatestData(userId, deviceId)
+}
+
+func (s *dataStorage) DeleteAck(userId string, deviceId string, acks [][]byte, requiredAcks int) (err error) {
+	defer s.observe("DeleteAck", time.Now(), &err)
+	return s.DataStorage.DeleteAck(userId, deviceId, acks, requiredAcks)
+}
+
+func (s *dataStorage) RemoveDeviceAcks(userId string, deviceId string, requiredAcks int) (err error) {
+	defer s.observe("RemoveDeviceAcks", time.Now(), &err)
+	return s.DataStorage.RemoveDeviceAcks(userId, deviceId, requiredAcks)
+}
+
+func (s *dataStorage) InsertData(data []byte, ackId []byte, recipientId string, expiresAt int64, quota storage.MailboxQuota) (err error) {
+	defer s.observe("InsertData", time.Now(), &err)
+	return s.DataStorage.InsertData(data, ackId, recipientId, expiresAt, quota)
+}
+
+func (s *dataStorage) PurgeExpiredData(now int64) (purged int64, err error) {
+	defer s.observe("PurgeExpiredData", time.Now(), &err)
+	return s.DataStorage.PurgeExpiredData(now)
+}
+
+func (s *dataStorage) GetMailboxUsage(userId string) (totalBytes int64, count int64, err error) {
+	defer s.observe("GetMailboxUsage", time.Now(), &err)
+	return s.DataStorage.GetMailboxUsage(userId)
+}
+
+func (s *dataStorage) GetTotalUsage() (totalBytes int64, count int64, err error) {
+	defer s.observe("GetTotalUsage", time.Now(), &err)
+	return s.DataStorage.GetTotalUsage()
+}
+
+func (s *dataStorage) PurgeMailbox(userId string) (purged int64, err error) {
+	defer s.observe("PurgeMailbox", time.Now(), &err)
+	return s.DataStorage.PurgeMailbox(userId)
+}
+
+func (s *dataStorage) EnqueueOutbound(msg storage.OutboundMessage) (err error) {
+	defer s.observe("EnqueueOutbound", time.Now(), &err)
+	return s.DataStorage.EnqueueOutbound(msg)
+}
+
+func (s *dataStorage) GetDueOutbound(now int64, limit int) (msgs []storage.OutboundMessage, err error) {
+	defer s.observe("GetDueOutbound", time.Now(), &err)
+	return s.DataStorage.GetDueOutbound(now, limit)
+}
+
+func (s *dataStorage) ClaimOutbound(id int64, nextAttempt int64, attempts int, retryAt int64) (claimed bool, err error) {
+	defer s.observe("ClaimOutbound", time.Now(), &err)
+	return s.DataStorage.ClaimOutbound(id, nextAttempt, attempts, retryAt)
+}
+
+func (s *dataStorage) DeleteOutbound(id int64) (err error) {
+	defer s.observe("DeleteOutbound", time.Now(), &err)
+	return s.DataStorage.DeleteOutbound(id)
+}
+
+func (s *dataStorage) MarkFederationMessageSeen(url string, messageId []byte, expiresAt int64) (firstSeen bool, err error) {
+	defer s.observe("MarkFederationMessageSeen", time.Now(), &err)
+	return s.DataStorage.MarkFederationMessageSeen(url, messageId, expiresAt)
+}
+
+func (s *dataStorage) UnmarkFederationMessageSeen(url string, messageId []byte) (err error) {
+	defer s.observe("UnmarkFederationMessageSeen", time.Now(), &err)
+	return s.DataStorage.UnmarkFederationMessageSeen(url, messageId)
+}
+
+func (s *dataStorage) PurgeExpiredFederationMessages(now int64) (purged int64, err error) {
+	defer s.observe("PurgeExpiredFederationMessages", time.Now(), &err)
+	return s.DataStorage.PurgeExpiredFederationMessages(now)
+}
+
+func (s *dataStorage) HealthCheck(ctx context.Context) error {
+	return s.healthCheck(ctx, s.DataStorage)
+}
+
+func (s *dataStreamer) GetDataSince(userId string, deviceId string, afterId int64) (records []storage.DataRecord, err error) {
+	defer s.observe("GetDataSince", time.Now(), &err)
+	return s.streamer.GetDataSince(userId, deviceId, afterId)
+}
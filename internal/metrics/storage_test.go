@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/sqlite"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDataStorageKeepsStreamer(t *testing.T) {
+	store, err := sqlite.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped := NewDataStorage("test", store)
+
+	streamer, ok := wrapped.(storage.DataStreamer)
+	if !ok {
+		t.Fatal("wrapped storage lost its DataStreamer implementation")
+	}
+
+	if err := wrapped.InsertData([]byte("hello"), make([]byte, 32), "1234567890123456", 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := streamer.GetDataSince("1234567890123456", "primary", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || string(records[0].Blob) != "hello" {
+		t.Fatalf("unexpected records: %v", records)
+	}
+
+	if n := testutil.CollectAndCount(StorageDuration, "coldwire_storage_call_duration_seconds"); n < 2 {
+		t.Fatalf("expected storage calls to be observed, got %d series", n)
+	}
+}
+
+func TestStorageErrorsAreCounted(t *testing.T) {
+	store, err := sqlite.New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped := NewUserStorage("test", store)
+
+	// Consuming an unknown challenge fails with storage.ErrChallengeNotFound.
+	if _, _, err := wrapped.ConsumeChallenge([]byte("unknown"), 0); err == nil {
+		t.Fatal("unknown challenge was consumed")
+	}
+
+	if got := testutil.ToFloat64(StorageErrors.WithLabelValues("test", "ConsumeChallenge")); got != 1 {
+		t.Fatalf("expected 1 counted error, got %v", got)
+	}
+}
@@ -0,0 +1,67 @@
+package notify
+
+import "sync"
+
+// Hub wakes up in-process waiters (e.g. long-polls) whenever new data is stored for a user.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value whenever Notify is called for userId.
+// Notifications are coalesced, so a slow reader only ever sees one pending wakeup.
+// The returned function must be called to release the subscription.
+func (h *Hub) Subscribe(userId string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	if h.subs[userId] == nil {
+		h.subs[userId] = make(map[chan struct{}]struct{})
+	}
+	h.subs[userId][ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.subs[userId], ch)
+		if len(h.subs[userId]) == 0 {
+			delete(h.subs, userId)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// NotifyAll wakes up every subscriber, for when notifications may have been missed.
+func (h *Hub) NotifyAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, subs := range h.subs {
+		for ch := range subs {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Notify wakes up every subscriber of userId, it never blocks.
+func (h *Hub) Notify(userId string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs[userId] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"testing"
+)
+
+func TestNotifyWakesOnlyRecipient(t *testing.T) {
+	hub := NewHub()
+
+	aliceCh, unsubscribeAlice := hub.Subscribe("1111111111111111")
+	defer unsubscribeAlice()
+
+	bobCh, unsubscribeBob := hub.Subscribe("2222222222222222")
+	defer unsubscribeBob()
+
+	// Notifications must coalesce and never block the notifier.
+	hub.Notify("1111111111111111")
+	hub.Notify("1111111111111111")
+
+	select {
+	case <-aliceCh:
+	default:
+		t.Fatal("alice was not notified")
+	}
+
+	select {
+	case <-aliceCh:
+		t.Fatal("alice received more than one pending notification")
+	default:
+	}
+
+	select {
+	case <-bobCh:
+		t.Fatal("bob was notified for alice's data")
+	default:
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	hub := NewHub()
+
+	_, unsubscribe := hub.Subscribe("1111111111111111")
+	unsubscribe()
+
+	if len(hub.subs) != 0 {
+		t.Fatalf("subscription was not released: %v", hub.subs)
+	}
+
+	// Must not panic or block with no subscribers.
+	hub.Notify("1111111111111111")
+}
+
+func TestNotifyAllWakesEverySubscriber(t *testing.T) {
+	hub := NewHub()
+
+	aliceCh, unsubscribeAlice := hub.Subscribe("1111111111111111")
+	defer unsubscribeAlice()
+
+	bobCh, unsubscribeBob := hub.Subscribe("2222222222222222")
+	defer unsubscribeBob()
+
+	hub.NotifyAll()
+
+	for name, ch := range map[string]<-chan struct{}{"alice": aliceCh, "bob": bobCh} {
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("%s was not notified", name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package backends opens the storage backends by the names User_storage and Data_storage accept.
+package backends
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/config"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/mysql"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/postgres"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/redis"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage/sqlite"
+)
+
+// Store is implemented by every backend, so any of them can serve as User storage and Data storage.
+type Store interface {
+	storage.UserStorage
+	storage.DataStorage
+}
+
+// Open connects to the backend called name, one of the names config.Validate accepts.
+func Open(name string, cfg *config.Config) (Store, error) {
+	s, err := open(name, cfg)
+	if err != nil {
+		// Don't hand out a nil backend pointer wrapped in a non-nil Store.
+		return nil, err
+	}
+	return s, nil
+}
+
+func open(name string, cfg *config.Config) (Store, error) {
+	switch name {
+	case "internal":
+		return sqlite.New(constants.SQLITE_DB_NAME)
+
+	case "sql":
+		return mysql.New(mysql.SQLDSN{
+			User:                 cfg.SQL.DBUser,
+			Passwd:               cfg.SQL.DBPassword,
+			Net:                  "tcp",
+			Addr:                 fmt.Sprintf("%s:%d", cfg.SQL.Host, cfg.SQL.Port),
+			DBName:               cfg.SQL.DBName,
+			ParseTime:            false,
+			AllowNativePasswords: true,
+			Collation:            "utf8mb4_unicode_ci",
+		})
+
+	case "postgres":
+		return postgres.New(postgres.PostgresDSN{
+			Host:     cfg.Postgres.Host,
+			Port:     cfg.Postgres.Port,
+			DBName:   cfg.Postgres.DBName,
+			User:     cfg.Postgres.DBUser,
+			Password: cfg.Postgres.DBPassword,
+			SSLMode:  cfg.Postgres.SSLMode,
+		})
+
+	case "redis":
+		portString := strconv.FormatUint(uint64(cfg.Redis.Port), 10)
+		return redis.New(cfg.Redis.Host, portString, cfg.Redis.Password, int(cfg.Redis.DB))
+
+	default:
+		return nil, fmt.Errorf("Unknown storage type (%s)", name)
+	}
+}
@@ -1,13 +1,24 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	gmysql "github.com/go-sql-driver/mysql"
 	"strings"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	gmysql "github.com/go-sql-driver/mysql"
 )
 
+// notifyPollInterval is how often Listen checks the data table for rows inserted by any server instance.
+const notifyPollInterval = time.Second
+
+// notifyRescanWindow is how long Listen keeps rescanning ids above the highest one it had seen, as concurrent inserts
+// may commit in a different order than their auto-increment ids were allocated.
+const notifyRescanWindow = 10 * time.Second
+
 type SQLStorage struct {
 	Db *sql.DB
 }
@@ -44,6 +55,51 @@ func New(dsn SQLDSN) (*SQLStorage, error) {
             ack_id BINARY(32) NOT NULL,
             recipient VARCHAR(529),
             data_blob MEDIUMBLOB
+        )`,
+		`CREATE TABLE IF NOT EXISTS outbound (
+            id BIGINT AUTO_INCREMENT PRIMARY KEY,
+            url VARCHAR(253) NOT NULL,
+            sender VARCHAR(16) NOT NULL,
+            recipient VARCHAR(16) NOT NULL,
+            data_blob MEDIUMBLOB NOT NULL,
+            message_id BINARY(16) NOT NULL,
+            created_at BIGINT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt BIGINT NOT NULL,
+            INDEX outbound_next_attempt_idx (next_attempt)
+        )`,
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+            jti VARCHAR(64) PRIMARY KEY,
+            expires_at BIGINT NOT NULL,
+            INDEX revoked_tokens_expires_at_idx (expires_at)
+        )`,
+		`CREATE TABLE IF NOT EXISTS reserved_user_ids (
+            id VARCHAR(16) PRIMARY KEY,
+            reserved_until BIGINT NOT NULL,
+            INDEX reserved_user_ids_reserved_until_idx (reserved_until)
+        )`,
+		`CREATE TABLE IF NOT EXISTS devices (
+            user_id VARCHAR(16) NOT NULL,
+            id VARCHAR(16) NOT NULL,
+            public_key VARBINARY(2592) NOT NULL UNIQUE,
+            created_at BIGINT NOT NULL,
+            PRIMARY KEY (user_id, id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS mailbox_locks (
+            recipient VARCHAR(529) PRIMARY KEY
+        )`,
+		`CREATE TABLE IF NOT EXISTS data_acks (
+            recipient VARCHAR(529) NOT NULL,
+            ack_id BINARY(32) NOT NULL,
+            device_id VARCHAR(16) NOT NULL,
+            PRIMARY KEY (recipient, ack_id, device_id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS federation_seen (
+            url VARCHAR(253) NOT NULL,
+            message_id BINARY(16) NOT NULL,
+            expires_at BIGINT NOT NULL,
+            PRIMARY KEY (url, message_id),
+            INDEX federation_seen_expires_at_idx (expires_at)
         )`,
 	}
 
@@ -53,15 +109,56 @@ func New(dsn SQLDSN) (*SQLStorage, error) {
 		}
 	}
 
+	// Columns added after the initial release, so databases created by older versions get them too.
+	columns := []struct{ table, column, definition string }{
+		{"data", "expires_at", "BIGINT NULL, ADD INDEX data_expires_at_idx (expires_at)"},
+		{"challenges", "created_at", "BIGINT NULL"},
+		{"challenges", "expires_at", "BIGINT NULL"},
+		{"users", "tokens_revoked_before", "BIGINT NULL"},
+		{"users", "banned_at", "BIGINT NULL"},
+	}
+
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, c.table, c.column, c.definition); err != nil {
+			return nil, fmt.Errorf("failed to add column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
 	return &SQLStorage{Db: db}, nil
 }
 
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`, table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 // Implement UserStorage interface
 func (s *SQLStorage) SaveUser(id string, publicKey []byte) error {
 	_, err := s.Db.Exec(`INSERT INTO users (id, public_key) VALUES (?, ?)`, id, publicKey)
 	return err
 }
 
+// UpdateUserPublicKey replaces the user's public-key, only if it is still oldPublicKey.
+func (s *SQLStorage) UpdateUserPublicKey(id string, oldPublicKey []byte, newPublicKey []byte) (bool, error) {
+	res, err := s.Db.Exec(`UPDATE users SET public_key = ? WHERE id = ? AND public_key = ?`, newPublicKey, id, oldPublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
 func (s *SQLStorage) GetUserPublicKeyById(id string) ([]byte, error) {
 	var publicKey []byte
 
@@ -76,8 +173,8 @@ func (s *SQLStorage) GetUserPublicKeyById(id string) ([]byte, error) {
 	return publicKey, nil
 }
 
-func (s *SQLStorage) SaveChallenge(challenge []byte, id interface{}, publicKey interface{}) error {
-	_, err := s.Db.Exec(`INSERT INTO challenges (challenge, id, public_key) VALUES (?, ?, ?)`, challenge, id, publicKey)
+func (s *SQLStorage) SaveChallenge(challenge []byte, id interface{}, publicKey interface{}, createdAt int64, expiresAt int64) error {
+	_, err := s.Db.Exec(`INSERT INTO challenges (challenge, id, public_key, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`, challenge, id, publicKey, createdAt, expiresAt)
 	return err
 }
 
@@ -113,18 +210,39 @@ func (s *SQLStorage) SaveCh(challenge []byte, id interface{}, publicKey interfac
 	return err
 }
 
-func (s *SQLStorage) GetChallengeData(challenge []byte) ([]byte, string, error) {
+// ConsumeChallenge locks, reads and deletes the challenge in one transaction,
+// so a challenge can only ever be verified once. Challenges issued for one of the user's devices carry the device's key.
+func (s *SQLStorage) ConsumeChallenge(challenge []byte, now int64) ([]byte, string, error) {
 	var (
 		publicKey []byte
 		userId    sql.NullString
 	)
 
-	err := s.Db.QueryRow("SELECT id, public_key FROM challenges WHERE challenge = ?", challenge).Scan(&userId, &publicKey)
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT id, public_key FROM challenges WHERE challenge = ? AND expires_at > ? FOR UPDATE", challenge, now).Scan(&userId, &publicKey)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", storage.ErrChallengeNotFound
+		}
 		return nil, "", err
 	}
 
-	if userId.Valid {
+	if _, err := tx.Exec("DELETE FROM challenges WHERE challenge = ?", challenge); err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	if userId.Valid && publicKey != nil {
+		return publicKey, userId.String, nil
+	} else if userId.Valid {
 		fetchedPublicKey, err := s.GetUserPublicKeyById(userId.String)
 		if err != nil {
 			return nil, "", err
@@ -143,9 +261,53 @@ func (s *SQLStorage) CleanupChallenges() error {
 	return err
 }
 
+func (s *SQLStorage) PurgeExpiredChallenges(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM challenges WHERE expires_at IS NULL OR expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// RevokeToken adds jti to the revocation list, it returns false if it was already revoked.
+func (s *SQLStorage) RevokeToken(jti string, expiresAt int64) (bool, error) {
+	res, err := s.Db.Exec(`INSERT IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)`, jti, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// RevokeUserTokens revokes every token of userId issued before issuedBefore, in Unix milliseconds.
+func (s *SQLStorage) RevokeUserTokens(userId string, issuedBefore int64) error {
+	_, err := s.Db.Exec(`UPDATE users SET tokens_revoked_before = ? WHERE id = ?`, issuedBefore, userId)
+	return err
+}
+
+// IsTokenRevoked also reports tokens of deleted users as revoked.
+func (s *SQLStorage) IsTokenRevoked(jti string, userId string, issuedAt int64) (bool, error) {
+	var revoked bool
+	err := s.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR NOT EXISTS(SELECT 1 FROM users WHERE id = ? AND (tokens_revoked_before IS NULL OR tokens_revoked_before <= ?))`, jti, userId, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+// PurgeExpiredRevocations deletes revoked tokens that would have expired anyway.
+func (s *SQLStorage) PurgeExpiredRevocations(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
 // / Implements DataStorage interface
-func (s *SQLStorage) GetLatestData(userId string) ([]byte, error) {
-	rows, err := s.Db.Query("SELECT data_blob, ack_id FROM data WHERE recipient = ? ORDER BY id", userId)
+func (s *SQLStorage) GetLatestData(userId string, deviceId string) ([]byte, error) {
+	rows, err := s.Db.Query("SELECT data_blob, ack_id FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?) AND "+notAckedBy+" ORDER BY id", userId, time.Now().Unix(), deviceId)
 	if err != nil {
 		return nil, err
 	}
@@ -173,7 +335,44 @@ func (s *SQLStorage) GetLatestData(userId string) ([]byte, error) {
 	return allData, nil
 }
 
-func (s *SQLStorage) DeleteAck(userId string, acks [][]byte) error {
+func (s *SQLStorage) GetDataSince(userId string, deviceId string, afterId int64) ([]storage.DataRecord, error) {
+	rows, err := s.Db.Query("SELECT id, ack_id, data_blob FROM data WHERE recipient = ? AND id > ? AND (expires_at IS NULL OR expires_at > ?) AND "+notAckedBy+" ORDER BY id", userId, afterId, time.Now().Unix(), deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []storage.DataRecord
+	for rows.Next() {
+		var record storage.DataRecord
+		if err := rows.Scan(&record.Id, &record.AckId, &record.Blob); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// notAckedBy filters out the blobs already acknowledged by the device given as its only argument.
+const notAckedBy = "NOT EXISTS (SELECT 1 FROM data_acks WHERE data_acks.recipient = data.recipient AND data_acks.ack_id = data.ack_id AND data_acks.device_id = ?)"
+
+// ackCount counts the devices that acknowledged a blob.
+const ackCount = "(SELECT COUNT(*) FROM data_acks WHERE data_acks.recipient = data.recipient AND data_acks.ack_id = data.ack_id)"
+
+// blobDeleted filters the acknowledgements whose blob is gone, they are deleted along with it.
+const blobDeleted = "NOT EXISTS (SELECT 1 FROM data WHERE data.recipient = data_acks.recipient AND data.ack_id = data_acks.ack_id)"
+
+// DeleteAck records the device's acknowledgements, and deletes the blobs acknowledged by at least requiredAcks devices.
+func (s *SQLStorage) DeleteAck(userId string, deviceId string, acks [][]byte, requiredAcks int) error {
+	if len(acks) == 0 {
+		return nil
+	}
+
 	placeholders := make([]string, len(acks))
 	args := make([]interface{}, len(acks))
 	for i, v := range acks {
@@ -181,18 +380,510 @@ func (s *SQLStorage) DeleteAck(userId string, acks [][]byte) error {
 		args[i] = v
 	}
 
-	args = append([]any{userId}, args...)
+	inAcks := fmt.Sprintf("ack_id IN (%s)", strings.Join(placeholders, ","))
+
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if requiredAcks <= 1 {
+		if _, err := tx.Exec("DELETE FROM data WHERE recipient = ? AND "+inAcks, append([]any{userId}, args...)...); err != nil {
+			return err
+		}
+	} else {
+		_, err := tx.Exec("INSERT IGNORE INTO data_acks (recipient, ack_id, device_id) SELECT recipient, ack_id, ? FROM data WHERE recipient = ? AND "+inAcks, append([]any{deviceId, userId}, args...)...)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM data WHERE recipient = ? AND "+inAcks+" AND "+ackCount+" >= ?", append(append([]any{userId}, args...), requiredAcks)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM data_acks WHERE recipient = ? AND "+inAcks+" AND "+blobDeleted, append([]any{userId}, args...)...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveDeviceAcks forgets the acknowledgements of a removed device, and deletes the blobs
+// that the remaining devices all acknowledged already.
+func (s *SQLStorage) RemoveDeviceAcks(userId string, deviceId string, requiredAcks int) error {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM data_acks WHERE recipient = ? AND device_id = ?`, userId, deviceId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM data WHERE recipient = ? AND "+ackCount+" >= ?", userId, max(requiredAcks, 1)); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM data_acks WHERE recipient = ? AND "+blobDeleted, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertData stores the blob unless it would exceed quota. Inserts for the same recipient are serialized
+// by locking its mailbox_locks row, so concurrent ones can't both fit. The row is created if missing,
+// and deleted by PurgeMailbox.
+func (s *SQLStorage) InsertData(dataBlob []byte, ackId []byte, recipientId string, expiresAt int64, quota storage.MailboxQuota) error {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locks the row whether it was just inserted or already there.
+	if _, err := tx.Exec(`INSERT INTO mailbox_locks (recipient) VALUES (?) ON DUPLICATE KEY UPDATE recipient = recipient`, recipientId); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	res, err := tx.Exec(`INSERT INTO data (recipient, ack_id, data_blob, expires_at) SELECT ?, ?, ?, ? FROM DUAL
+		WHERE (? = 0 OR (SELECT COUNT(*) FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?)) < ?)
+		AND (? = 0 OR (SELECT COALESCE(SUM(LENGTH(data_blob)), 0) FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?)) + ? <= ?)`,
+		recipientId, ackId, dataBlob, nullableExpiry(expiresAt),
+		quota.MaxMessages, recipientId, now, quota.MaxMessages,
+		quota.MaxBytes, recipientId, now, len(dataBlob), quota.MaxBytes)
+	if err != nil {
+		return err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if inserted == 0 {
+		return fmt.Errorf("%w: (%s)", storage.ErrMailboxFull, recipientId)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStorage) PurgeExpiredData(now int64) (int64, error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The acknowledgements go along with their blobs.
+	if _, err := tx.Exec(`DELETE FROM data_acks WHERE (recipient, ack_id) IN (SELECT recipient, ack_id FROM data WHERE expires_at IS NOT NULL AND expires_at <= ?)`, now); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM data WHERE expires_at IS NOT NULL AND expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit()
+}
+
+// GetMailboxUsage returns the size and number of undelivered blobs stored for userId.
+func (s *SQLStorage) GetMailboxUsage(userId string) (int64, int64, error) {
+	var totalBytes, count int64
+	err := s.Db.QueryRow("SELECT COALESCE(SUM(LENGTH(data_blob)), 0), COUNT(*) FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?)", userId, time.Now().Unix()).Scan(&totalBytes, &count)
+	return totalBytes, count, err
+}
+
+// GetTotalUsage returns the size and number of undelivered blobs stored for every user.
+func (s *SQLStorage) GetTotalUsage() (int64, int64, error) {
+	var totalBytes, count int64
+	err := s.Db.QueryRow("SELECT COALESCE(SUM(LENGTH(data_blob)), 0), COUNT(*) FROM data WHERE expires_at IS NULL OR expires_at > ?", time.Now().Unix()).Scan(&totalBytes, &count)
+	return totalBytes, count, err
+}
+
+// nullableExpiry stores "never expires" as NULL.
+func nullableExpiry(expiresAt int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: expiresAt, Valid: expiresAt != 0}
+}
+
+// Implements Notifier interface
+
+// Publish is a no-op, Listen picks up new rows straight from the data table.
+func (s *SQLStorage) Publish(recipientId string) error {
+	return nil
+}
+
+// Listen polls the data table once per interval for the whole server instance,
+// and calls onNotify for every recipient with newly inserted rows.
+// Rows are looked up from the highest id seen notifyRescanWindow ago, so that rows committed after others with a
+// higher id are still picked up, and each row is only notified once.
+func (s *SQLStorage) Listen(ctx context.Context, onNotify func(recipientId string)) error {
+	var floor int64
+	if err := s.Db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM data`).Scan(&floor); err != nil {
+		return err
+	}
+
+	type highWater struct {
+		at time.Time
+		id int64
+	}
 
-	query := fmt.Sprintf("DELETE FROM data WHERE recipient = ? AND ack_id IN (%s)", strings.Join(placeholders, ","))
-	_, err := s.Db.Exec(query, args...)
+	var (
+		lastId = floor
+		marks  []highWater
+		seen   = make(map[int64]bool)
+	)
+
+	ticker := time.NewTicker(notifyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			rows, err := s.Db.QueryContext(ctx, `SELECT id, recipient FROM data WHERE id > ?`, floor)
+			if err != nil {
+				return err
+			}
+
+			recipients := make(map[string]bool)
+			for rows.Next() {
+				var (
+					id        int64
+					recipient string
+				)
+				if err := rows.Scan(&id, &recipient); err != nil {
+					rows.Close()
+					return err
+				}
+
+				if seen[id] {
+					continue
+				}
+				seen[id] = true
+				lastId = max(lastId, id)
+				recipients[recipient] = true
+			}
+			rows.Close()
+
+			if err := rows.Err(); err != nil {
+				return err
+			}
+
+			// Ids below the highest one seen a window ago are no longer expected to commit.
+			now := time.Now()
+			marks = append(marks, highWater{at: now, id: lastId})
+			for len(marks) > 0 && now.Sub(marks[0].at) >= notifyRescanWindow {
+				floor = marks[0].id
+				marks = marks[1:]
+			}
+
+			for id := range seen {
+				if id <= floor {
+					delete(seen, id)
+				}
+			}
+
+			for recipient := range recipients {
+				onNotify(recipient)
+			}
+		}
+	}
+}
+
+func (s *SQLStorage) EnqueueOutbound(msg storage.OutboundMessage) error {
+	_, err := s.Db.Exec(`INSERT INTO outbound (url, sender, recipient, data_blob, message_id, created_at, attempts, next_attempt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.Url, msg.Sender, msg.Recipient, msg.Blob, msg.MessageId, msg.CreatedAt, msg.Attempts, msg.NextAttempt)
+	return err
+}
+
+func (s *SQLStorage) GetDueOutbound(now int64, limit int) ([]storage.OutboundMessage, error) {
+	rows, err := s.Db.Query(`SELECT id, url, sender, recipient, data_blob, message_id, created_at, attempts, next_attempt FROM outbound WHERE next_attempt <= ? ORDER BY next_attempt LIMIT ?`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []storage.OutboundMessage
+	for rows.Next() {
+		var msg storage.OutboundMessage
+		if err := rows.Scan(&msg.Id, &msg.Url, &msg.Sender, &msg.Recipient, &msg.Blob, &msg.MessageId, &msg.CreatedAt, &msg.Attempts, &msg.NextAttempt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// ClaimOutbound reschedules the message only if nobody else did since we fetched it,
+// so that concurrent workers never deliver the same message twice.
+func (s *SQLStorage) ClaimOutbound(id int64, nextAttempt int64, attempts int, retryAt int64) (bool, error) {
+	res, err := s.Db.Exec(`UPDATE outbound SET attempts = ?, next_attempt = ? WHERE id = ? AND next_attempt = ?`, attempts, retryAt, id, nextAttempt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *SQLStorage) DeleteOutbound(id int64) error {
+	_, err := s.Db.Exec(`DELETE FROM outbound WHERE id = ?`, id)
 	return err
 }
 
-func (s *SQLStorage) InsertData(dataBlob []byte, ackId []byte, recipientId string) error {
-	_, err := s.Db.Exec(`INSERT INTO data (recipient, ack_id, data_blob) VALUES (?, ?, ?)`, recipientId, ackId, dataBlob)
+// MarkFederationMessageSeen records a message received from url, and returns false if it was already recorded.
+func (s *SQLStorage) MarkFederationMessageSeen(url string, messageId []byte, expiresAt int64) (bool, error) {
+	res, err := s.Db.Exec(`INSERT IGNORE INTO federation_seen (url, message_id, expires_at) VALUES (?, ?, ?)`, url, messageId, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// UnmarkFederationMessageSeen forgets a message that could not be stored, so that its retry is accepted.
+func (s *SQLStorage) UnmarkFederationMessageSeen(url string, messageId []byte) error {
+	_, err := s.Db.Exec(`DELETE FROM federation_seen WHERE url = ? AND message_id = ?`, url, messageId)
 	return err
 }
 
+func (s *SQLStorage) PurgeExpiredFederationMessages(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM federation_seen WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Administration
+
+func (s *SQLStorage) ListUsers() ([]string, error) {
+	rows, err := s.Db.Query(`SELECT id FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// DeleteUser deletes the user, its devices and pending challenges, and keeps its ID from being reissued until reservedUntil.
+// It returns false if the user did not exist.
+func (s *SQLStorage) DeleteUser(id string, reservedUntil int64) (bool, error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM challenges WHERE id = ?`, id); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM devices WHERE user_id = ?`, id); err != nil {
+		return false, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO reserved_user_ids (id, reserved_until) VALUES (?, ?) ON DUPLICATE KEY UPDATE reserved_until = VALUES(reserved_until)`, id, reservedUntil); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// IsUserIdReserved reports whether id belonged to a user deleted less than the reuse cooldown ago.
+func (s *SQLStorage) IsUserIdReserved(id string, now int64) (bool, error) {
+	var reserved bool
+	err := s.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM reserved_user_ids WHERE id = ? AND reserved_until > ?)`, id, now).Scan(&reserved)
+	return reserved, err
+}
+
+// PurgeExpiredReservations frees the IDs of deleted users whose cooldown is over.
+func (s *SQLStorage) PurgeExpiredReservations(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM reserved_user_ids WHERE reserved_until <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// SetUserBan bans the user since bannedAt, or lifts the ban if bannedAt is 0. It returns false if the user does not exist.
+func (s *SQLStorage) SetUserBan(id string, bannedAt int64) (bool, error) {
+	res, err := s.Db.Exec(`UPDATE users SET banned_at = ? WHERE id = ?`, sql.NullInt64{Int64: bannedAt, Valid: bannedAt != 0}, id)
+	if err != nil {
+		return false, err
+	}
+
+	// MySQL doesn't count rows that already had the value as affected.
+	affected, err := res.RowsAffected()
+	if err != nil || affected > 0 {
+		return affected > 0, err
+	}
+	return s.CheckUserIdExists(id)
+}
+
+// GetUserBan returns when the user was banned, 0 if it isn't.
+func (s *SQLStorage) GetUserBan(id string) (int64, error) {
+	var bannedAt sql.NullInt64
+	err := s.Db.QueryRow(`SELECT banned_at FROM users WHERE id = ?`, id).Scan(&bannedAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return bannedAt.Int64, err
+}
+
+func (s *SQLStorage) ListServers() ([]storage.ServerInfo, error) {
+	rows, err := s.Db.Query(`SELECT url, public_key, refetch_date FROM servers ORDER BY url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var servers []storage.ServerInfo
+	for rows.Next() {
+		var server storage.ServerInfo
+		if err := rows.Scan(&server.Url, &server.PublicKey, &server.RefetchDate); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	return servers, rows.Err()
+}
+
+// DeleteServerInfo forgets a federated server's key, it is fetched again on its next request.
+func (s *SQLStorage) DeleteServerInfo(url string) (bool, error) {
+	res, err := s.Db.Exec(`DELETE FROM servers WHERE url = ?`, url)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// PurgeMailbox deletes every blob stored for userId, expired or not.
+// PurgeMailbox also deletes the mailbox_locks row of userId, first so that it waits for inserts in progress,
+// which recreate it if more data comes in.
+func (s *SQLStorage) PurgeMailbox(userId string) (int64, error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM mailbox_locks WHERE recipient = ?`, userId); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM data WHERE recipient = ?`, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM data_acks WHERE recipient = ?`, userId); err != nil {
+		return 0, err
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit()
+}
+
+// Devices
+
+func (s *SQLStorage) AddDevice(userId string, deviceId string, publicKey []byte, createdAt int64) error {
+	_, err := s.Db.Exec(`INSERT INTO devices (user_id, id, public_key, created_at) VALUES (?, ?, ?, ?)`, userId, deviceId, publicKey, createdAt)
+	return err
+}
+
+// GetDevicePublicKey returns nil if the device is not registered to the user.
+func (s *SQLStorage) GetDevicePublicKey(userId string, deviceId string) ([]byte, error) {
+	var publicKey []byte
+	err := s.Db.QueryRow(`SELECT public_key FROM devices WHERE user_id = ? AND id = ?`, userId, deviceId).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return publicKey, err
+}
+
+func (s *SQLStorage) ListDevices(userId string) ([]storage.Device, error) {
+	rows, err := s.Db.Query(`SELECT id, public_key, created_at FROM devices WHERE user_id = ? ORDER BY created_at, id`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []storage.Device
+	for rows.Next() {
+		var device storage.Device
+		if err := rows.Scan(&device.Id, &device.PublicKey, &device.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// RemoveDevice returns false if the device was not registered to the user.
+func (s *SQLStorage) RemoveDevice(userId string, deviceId string) (bool, error) {
+	res, err := s.Db.Exec(`DELETE FROM devices WHERE user_id = ? AND id = ?`, userId, deviceId)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
 // Shared methods by UserStorage and DataStorage
 
 func (s *SQLStorage) CheckUserIdExists(id string) (bool, error) {
@@ -204,6 +895,11 @@ func (s *SQLStorage) CheckUserIdExists(id string) (bool, error) {
 	return exists, nil
 }
 
+// HealthCheck pings the database.
+func (s *SQLStorage) HealthCheck(ctx context.Context) error {
+	return s.Db.PingContext(ctx)
+}
+
 func (s *SQLStorage) ExitCleanup() error {
 	return s.Db.Close()
 }
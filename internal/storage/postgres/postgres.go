@@ -0,0 +1,802 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/lib/pq"
+)
+
+// NotifyChannel is the LISTEN/NOTIFY channel InsertData signals on, the payload is the recipient ID.
+const NotifyChannel = "coldwire_data"
+
+type PostgresStorage struct {
+	Db  *sql.DB
+	dsn string
+}
+
+type PostgresDSN struct {
+	Host     string
+	Port     uint16
+	DBName   string
+	User     string
+	Password string
+	SSLMode  string
+}
+
+func (d PostgresDSN) FormatDSN() string {
+	u := url.URL{
+		Scheme: "postgres",
+		User:   url.UserPassword(d.User, d.Password),
+		Host:   net.JoinHostPort(d.Host, strconv.FormatUint(uint64(d.Port), 10)),
+		Path:   "/" + d.DBName,
+	}
+
+	if d.SSLMode != "" {
+		u.RawQuery = url.Values{"sslmode": {d.SSLMode}}.Encode()
+	}
+
+	return u.String()
+}
+
+func New(dsn PostgresDSN) (*PostgresStorage, error) {
+	dsnString := dsn.FormatDSN()
+
+	db, err := sql.Open("postgres", dsnString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres db: %w", err)
+	}
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+            id VARCHAR(16) PRIMARY KEY,
+            public_key BYTEA NOT NULL UNIQUE
+        )`,
+		`CREATE TABLE IF NOT EXISTS servers (
+            url VARCHAR(512) PRIMARY KEY,
+            public_key BYTEA UNIQUE NOT NULL,
+            refetch_date VARCHAR(16) NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS challenges (
+            challenge BYTEA PRIMARY KEY,
+            id VARCHAR(16),
+            public_key BYTEA
+        )`,
+		`CREATE TABLE IF NOT EXISTS data (
+            id BIGSERIAL PRIMARY KEY,
+            ack_id BYTEA NOT NULL,
+            recipient VARCHAR(270) NOT NULL,
+            data_blob BYTEA NOT NULL
+        )`,
+		`CREATE INDEX IF NOT EXISTS data_recipient_idx ON data (recipient, id)`,
+		`CREATE TABLE IF NOT EXISTS outbound (
+            id BIGSERIAL PRIMARY KEY,
+            url VARCHAR(253) NOT NULL,
+            sender VARCHAR(16) NOT NULL,
+            recipient VARCHAR(16) NOT NULL,
+            data_blob BYTEA NOT NULL,
+            message_id BYTEA NOT NULL,
+            created_at BIGINT NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt BIGINT NOT NULL
+        )`,
+		`CREATE INDEX IF NOT EXISTS outbound_next_attempt_idx ON outbound (next_attempt)`,
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+            jti VARCHAR(64) PRIMARY KEY,
+            expires_at BIGINT NOT NULL
+        )`,
+		`CREATE INDEX IF NOT EXISTS revoked_tokens_expires_at_idx ON revoked_tokens (expires_at)`,
+		`CREATE TABLE IF NOT EXISTS reserved_user_ids (
+            id VARCHAR(16) PRIMARY KEY,
+            reserved_until BIGINT NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS devices (
+            user_id VARCHAR(16) NOT NULL,
+            id VARCHAR(16) NOT NULL,
+            public_key BYTEA NOT NULL UNIQUE,
+            created_at BIGINT NOT NULL,
+            PRIMARY KEY (user_id, id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS data_acks (
+            recipient VARCHAR(270) NOT NULL,
+            ack_id BYTEA NOT NULL,
+            device_id VARCHAR(16) NOT NULL,
+            PRIMARY KEY (recipient, ack_id, device_id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS federation_seen (
+            url VARCHAR(253) NOT NULL,
+            message_id BYTEA NOT NULL,
+            expires_at BIGINT NOT NULL,
+            PRIMARY KEY (url, message_id)
+        )`,
+		`CREATE INDEX IF NOT EXISTS federation_seen_expires_at_idx ON federation_seen (expires_at)`,
+
+		// Columns added after the initial release, so databases created by older versions get them too.
+		`ALTER TABLE data ADD COLUMN IF NOT EXISTS expires_at BIGINT`,
+		`CREATE INDEX IF NOT EXISTS data_expires_at_idx ON data (expires_at)`,
+		`ALTER TABLE challenges ADD COLUMN IF NOT EXISTS created_at BIGINT`,
+		`ALTER TABLE challenges ADD COLUMN IF NOT EXISTS expires_at BIGINT`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS tokens_revoked_before BIGINT`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS banned_at BIGINT`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("failed to exec statement %q: %w", stmt, err)
+		}
+	}
+
+	return &PostgresStorage{Db: db, dsn: dsnString}, nil
+}
+
+// Implement UserStorage interface
+func (s *PostgresStorage) SaveUser(id string, publicKey []byte) error {
+	_, err := s.Db.Exec(`INSERT INTO users (id, public_key) VALUES ($1, $2)`, id, publicKey)
+	return err
+}
+
+// UpdateUserPublicKey replaces the user's public-key, only if it is still oldPublicKey.
+func (s *PostgresStorage) UpdateUserPublicKey(id string, oldPublicKey []byte, newPublicKey []byte) (bool, error) {
+	res, err := s.Db.Exec(`UPDATE users SET public_key = $1 WHERE id = $2 AND public_key = $3`, newPublicKey, id, oldPublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *PostgresStorage) GetUserPublicKeyById(id string) ([]byte, error) {
+	var publicKey []byte
+
+	err := s.Db.QueryRow("SELECT public_key FROM users WHERE id = $1", id).Scan(&publicKey)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return publicKey, nil
+}
+
+func (s *PostgresStorage) SaveChallenge(challenge []byte, id interface{}, publicKey interface{}, createdAt int64, expiresAt int64) error {
+	_, err := s.Db.Exec(`INSERT INTO challenges (challenge, id, public_key, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)`, challenge, id, publicKey, createdAt, expiresAt)
+	return err
+}
+
+func (s *PostgresStorage) SaveServerInfo(url string, publicKey []byte, refetchDate string) error {
+	_, err := s.Db.Exec(`INSERT INTO servers (url, public_key, refetch_date) VALUES ($1, $2, $3)
+        ON CONFLICT (url) DO UPDATE SET public_key = EXCLUDED.public_key, refetch_date = EXCLUDED.refetch_date`,
+		url, publicKey, refetchDate)
+	return err
+}
+
+func (s *PostgresStorage) GetServerInfo(url string) ([]byte, string, error) {
+	var (
+		publicKey   []byte
+		refetchDate string
+	)
+	err := s.Db.QueryRow("SELECT public_key, refetch_date FROM servers WHERE url = $1", url).Scan(&publicKey, &refetchDate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	return publicKey, refetchDate, nil
+}
+
+// ConsumeChallenge deletes the challenge and returns its data in a single statement,
+// so a challenge can only ever be verified once. Challenges issued for one of the user's devices carry the device's key.
+func (s *PostgresStorage) ConsumeChallenge(challenge []byte, now int64) ([]byte, string, error) {
+	var (
+		publicKey []byte
+		userId    sql.NullString
+	)
+
+	err := s.Db.QueryRow("DELETE FROM challenges WHERE challenge = $1 AND expires_at > $2 RETURNING id, public_key", challenge, now).Scan(&userId, &publicKey)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", storage.ErrChallengeNotFound
+		}
+		return nil, "", err
+	}
+
+	if userId.Valid && publicKey != nil {
+		return publicKey, userId.String, nil
+	} else if userId.Valid {
+		fetchedPublicKey, err := s.GetUserPublicKeyById(userId.String)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return fetchedPublicKey, userId.String, nil
+	} else if publicKey != nil {
+		return publicKey, "", nil
+	} else {
+		return nil, "", errors.New("Both userId and publicKey are null! This is a bug, if you see this message, please open an issue on Github")
+	}
+}
+
+func (s *PostgresStorage) CleanupChallenges() error {
+	_, err := s.Db.Exec(`DELETE FROM challenges`)
+	return err
+}
+
+func (s *PostgresStorage) PurgeExpiredChallenges(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM challenges WHERE expires_at IS NULL OR expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// RevokeToken adds jti to the revocation list, it returns false if it was already revoked.
+func (s *PostgresStorage) RevokeToken(jti string, expiresAt int64) (bool, error) {
+	res, err := s.Db.Exec(`INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING`, jti, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// RevokeUserTokens revokes every token of userId issued before issuedBefore, in Unix milliseconds.
+func (s *PostgresStorage) RevokeUserTokens(userId string, issuedBefore int64) error {
+	_, err := s.Db.Exec(`UPDATE users SET tokens_revoked_before = $1 WHERE id = $2`, issuedBefore, userId)
+	return err
+}
+
+// IsTokenRevoked also reports tokens of deleted users as revoked.
+func (s *PostgresStorage) IsTokenRevoked(jti string, userId string, issuedAt int64) (bool, error) {
+	var revoked bool
+	err := s.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = $1)
+		OR NOT EXISTS(SELECT 1 FROM users WHERE id = $2 AND (tokens_revoked_before IS NULL OR tokens_revoked_before <= $3))`, jti, userId, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+// PurgeExpiredRevocations deletes revoked tokens that would have expired anyway.
+func (s *PostgresStorage) PurgeExpiredRevocations(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// / Implements DataStorage interface
+func (s *PostgresStorage) GetLatestData(userId string, deviceId string) ([]byte, error) {
+	rows, err := s.Db.Query("SELECT data_blob, ack_id FROM data WHERE recipient = $1 AND (expires_at IS NULL OR expires_at > $2) AND "+notAckedBy("$3")+" ORDER BY id", userId, time.Now().Unix(), deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var allData []byte
+	for rows.Next() {
+		var (
+			data  []byte
+			ackId []byte
+		)
+
+		if err := rows.Scan(&data, &ackId); err != nil {
+			return nil, err
+		}
+
+		data = append(ackId, data...)
+		allData = append(allData, data...)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return allData, nil
+}
+
+func (s *PostgresStorage) GetDataSince(userId string, deviceId string, afterId int64) ([]storage.DataRecord, error) {
+	rows, err := s.Db.Query("SELECT id, ack_id, data_blob FROM data WHERE recipient = $1 AND id > $2 AND (expires_at IS NULL OR expires_at > $3) AND "+notAckedBy("$4")+" ORDER BY id", userId, afterId, time.Now().Unix(), deviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []storage.DataRecord
+	for rows.Next() {
+		var record storage.DataRecord
+		if err := rows.Scan(&record.Id, &record.AckId, &record.Blob); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// notAckedBy filters out the blobs already acknowledged by the device given as param.
+func notAckedBy(param string) string {
+	return "NOT EXISTS (SELECT 1 FROM data_acks WHERE data_acks.recipient = data.recipient AND data_acks.ack_id = data.ack_id AND data_acks.device_id = " + param + ")"
+}
+
+// ackCount counts the devices that acknowledged a blob.
+const ackCount = "(SELECT COUNT(*) FROM data_acks WHERE data_acks.recipient = data.recipient AND data_acks.ack_id = data.ack_id)"
+
+// blobDeleted filters the acknowledgements whose blob is gone, they are deleted along with it.
+const blobDeleted = "NOT EXISTS (SELECT 1 FROM data WHERE data.recipient = data_acks.recipient AND data.ack_id = data_acks.ack_id)"
+
+// DeleteAck records the device's acknowledgements, and deletes the blobs acknowledged by at least requiredAcks devices.
+func (s *PostgresStorage) DeleteAck(userId string, deviceId string, acks [][]byte, requiredAcks int) error {
+	if len(acks) == 0 {
+		return nil
+	}
+
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if requiredAcks <= 1 {
+		if _, err := tx.Exec(`DELETE FROM data WHERE recipient = $1 AND ack_id = ANY($2)`, userId, pq.ByteaArray(acks)); err != nil {
+			return err
+		}
+	} else {
+		_, err := tx.Exec(`INSERT INTO data_acks (recipient, ack_id, device_id) SELECT recipient, ack_id, $1 FROM data WHERE recipient = $2 AND ack_id = ANY($3) ON CONFLICT DO NOTHING`, deviceId, userId, pq.ByteaArray(acks))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`DELETE FROM data WHERE recipient = $1 AND ack_id = ANY($2) AND `+ackCount+` >= $3`, userId, pq.ByteaArray(acks), requiredAcks)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM data_acks WHERE recipient = $1 AND ack_id = ANY($2) AND `+blobDeleted, userId, pq.ByteaArray(acks)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// RemoveDeviceAcks forgets the acknowledgements of a removed device, and deletes the blobs
+// that the remaining devices all acknowledged already.
+func (s *PostgresStorage) RemoveDeviceAcks(userId string, deviceId string, requiredAcks int) error {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM data_acks WHERE recipient = $1 AND device_id = $2`, userId, deviceId); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM data WHERE recipient = $1 AND `+ackCount+` >= $2`, userId, max(requiredAcks, 1)); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM data_acks WHERE recipient = $1 AND `+blobDeleted, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// InsertData stores the blob unless it would exceed quota and, in the same transaction, notifies NotifyChannel listeners.
+// Inserts for the same recipient are serialized by an advisory lock, so concurrent ones can't both fit.
+// Postgres only delivers the notification once the transaction commits.
+func (s *PostgresStorage) InsertData(dataBlob []byte, ackId []byte, recipientId string, expiresAt int64, quota storage.MailboxQuota) error {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, recipientId); err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`INSERT INTO data (recipient, ack_id, data_blob, expires_at) SELECT $1::TEXT, $2::BYTEA, $3::BYTEA, $4::BIGINT
+		WHERE ($5::BIGINT = 0 OR (SELECT COUNT(*) FROM data WHERE recipient = $1 AND (expires_at IS NULL OR expires_at > $6)) < $5)
+		AND ($7::BIGINT = 0 OR (SELECT COALESCE(SUM(OCTET_LENGTH(data_blob)), 0) FROM data WHERE recipient = $1 AND (expires_at IS NULL OR expires_at > $6)) + $8 <= $7)`,
+		recipientId, ackId, dataBlob, nullableExpiry(expiresAt), quota.MaxMessages, time.Now().Unix(), quota.MaxBytes, len(dataBlob))
+	if err != nil {
+		return err
+	}
+
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if inserted == 0 {
+		return fmt.Errorf("%w: (%s)", storage.ErrMailboxFull, recipientId)
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, NotifyChannel, recipientId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStorage) PurgeExpiredData(now int64) (int64, error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The acknowledgements go along with their blobs.
+	if _, err := tx.Exec(`DELETE FROM data_acks WHERE (recipient, ack_id) IN (SELECT recipient, ack_id FROM data WHERE expires_at IS NOT NULL AND expires_at <= $1)`, now); err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM data WHERE expires_at IS NOT NULL AND expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	purged, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return purged, tx.Commit()
+}
+
+// GetMailboxUsage returns the size and number of undelivered blobs stored for userId.
+func (s *PostgresStorage) GetMailboxUsage(userId string) (int64, int64, error) {
+	var totalBytes, count int64
+	err := s.Db.QueryRow("SELECT COALESCE(SUM(OCTET_LENGTH(data_blob)), 0), COUNT(*) FROM data WHERE recipient = $1 AND (expires_at IS NULL OR expires_at > $2)", userId, time.Now().Unix()).Scan(&totalBytes, &count)
+	return totalBytes, count, err
+}
+
+// GetTotalUsage returns the size and number of undelivered blobs stored for every user.
+func (s *PostgresStorage) GetTotalUsage() (int64, int64, error) {
+	var totalBytes, count int64
+	err := s.Db.QueryRow("SELECT COALESCE(SUM(OCTET_LENGTH(data_blob)), 0), COUNT(*) FROM data WHERE expires_at IS NULL OR expires_at > $1", time.Now().Unix()).Scan(&totalBytes, &count)
+	return totalBytes, count, err
+}
+
+// nullableExpiry stores "never expires" as NULL.
+func nullableExpiry(expiresAt int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: expiresAt, Valid: expiresAt != 0}
+}
+
+// Publish is a no-op, InsertData already notifies NotifyChannel listeners.
+func (s *PostgresStorage) Publish(recipientId string) error {
+	return nil
+}
+
+// Listen subscribes to NotifyChannel and calls onNotify with the recipient ID of every inserted blob,
+// until ctx is cancelled.
+func (s *PostgresStorage) Listen(ctx context.Context, onNotify func(recipientId string)) error {
+	listener := pq.NewListener(s.dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.Error("Postgres listener event", "event", ev, "error", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(NotifyChannel); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case n := <-listener.Notify:
+			// A nil notification means the connection was re-established, and we may have missed some.
+			if n == nil {
+				onNotify("")
+				continue
+			}
+			onNotify(n.Extra)
+		}
+	}
+}
+
+func (s *PostgresStorage) EnqueueOutbound(msg storage.OutboundMessage) error {
+	_, err := s.Db.Exec(`INSERT INTO outbound (url, sender, recipient, data_blob, message_id, created_at, attempts, next_attempt) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		msg.Url, msg.Sender, msg.Recipient, msg.Blob, msg.MessageId, msg.CreatedAt, msg.Attempts, msg.NextAttempt)
+	return err
+}
+
+func (s *PostgresStorage) GetDueOutbound(now int64, limit int) ([]storage.OutboundMessage, error) {
+	rows, err := s.Db.Query(`SELECT id, url, sender, recipient, data_blob, message_id, created_at, attempts, next_attempt FROM outbound WHERE next_attempt <= $1 ORDER BY next_attempt LIMIT $2`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []storage.OutboundMessage
+	for rows.Next() {
+		var msg storage.OutboundMessage
+		if err := rows.Scan(&msg.Id, &msg.Url, &msg.Sender, &msg.Recipient, &msg.Blob, &msg.MessageId, &msg.CreatedAt, &msg.Attempts, &msg.NextAttempt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// ClaimOutbound reschedules the message only if nobody else did since we fetched it,
+// so that concurrent workers never deliver the same message twice.
+func (s *PostgresStorage) ClaimOutbound(id int64, nextAttempt int64, attempts int, retryAt int64) (bool, error) {
+	res, err := s.Db.Exec(`UPDATE outbound SET attempts = $1, next_attempt = $2 WHERE id = $3 AND next_attempt = $4`, attempts, retryAt, id, nextAttempt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *PostgresStorage) DeleteOutbound(id int64) error {
+	_, err := s.Db.Exec(`DELETE FROM outbound WHERE id = $1`, id)
+	return err
+}
+
+// MarkFederationMessageSeen records a message received from url, and returns false if it was already recorded.
+func (s *PostgresStorage) MarkFederationMessageSeen(url string, messageId []byte, expiresAt int64) (bool, error) {
+	res, err := s.Db.Exec(`INSERT INTO federation_seen (url, message_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (url, message_id) DO NOTHING`, url, messageId, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// UnmarkFederationMessageSeen forgets a message that could not be stored, so that its retry is accepted.
+func (s *PostgresStorage) UnmarkFederationMessageSeen(url string, messageId []byte) error {
+	_, err := s.Db.Exec(`DELETE FROM federation_seen WHERE url = $1 AND message_id = $2`, url, messageId)
+	return err
+}
+
+func (s *PostgresStorage) PurgeExpiredFederationMessages(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM federation_seen WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Administration
+
+func (s *PostgresStorage) ListUsers() ([]string, error) {
+	rows, err := s.Db.Query(`SELECT id FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// DeleteUser deletes the user, its devices and pending challenges, and keeps its ID from being reissued until reservedUntil.
+// It returns false if the user did not exist.
+func (s *PostgresStorage) DeleteUser(id string, reservedUntil int64) (bool, error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM challenges WHERE id = $1`, id); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM devices WHERE user_id = $1`, id); err != nil {
+		return false, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM users WHERE id = $1`, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO reserved_user_ids (id, reserved_until) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET reserved_until = EXCLUDED.reserved_until`, id, reservedUntil); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// IsUserIdReserved reports whether id belonged to a user deleted less than the reuse cooldown ago.
+func (s *PostgresStorage) IsUserIdReserved(id string, now int64) (bool, error) {
+	var reserved bool
+	err := s.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM reserved_user_ids WHERE id = $1 AND reserved_until > $2)`, id, now).Scan(&reserved)
+	return reserved, err
+}
+
+// PurgeExpiredReservations frees the IDs of deleted users whose cooldown is over.
+func (s *PostgresStorage) PurgeExpiredReservations(now int64) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM reserved_user_ids WHERE reserved_until <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// SetUserBan bans the user since bannedAt, or lifts the ban if bannedAt is 0. It returns false if the user does not exist.
+func (s *PostgresStorage) SetUserBan(id string, bannedAt int64) (bool, error) {
+	res, err := s.Db.Exec(`UPDATE users SET banned_at = $1 WHERE id = $2`, sql.NullInt64{Int64: bannedAt, Valid: bannedAt != 0}, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// GetUserBan returns when the user was banned, 0 if it isn't.
+func (s *PostgresStorage) GetUserBan(id string) (int64, error) {
+	var bannedAt sql.NullInt64
+	err := s.Db.QueryRow(`SELECT banned_at FROM users WHERE id = $1`, id).Scan(&bannedAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return bannedAt.Int64, err
+}
+
+func (s *PostgresStorage) ListServers() ([]storage.ServerInfo, error) {
+	rows, err := s.Db.Query(`SELECT url, public_key, refetch_date FROM servers ORDER BY url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var servers []storage.ServerInfo
+	for rows.Next() {
+		var server storage.ServerInfo
+		if err := rows.Scan(&server.Url, &server.PublicKey, &server.RefetchDate); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	return servers, rows.Err()
+}
+
+// DeleteServerInfo forgets a federated server's key, it is fetched again on its next request.
+func (s *PostgresStorage) DeleteServerInfo(url string) (bool, error) {
+	res, err := s.Db.Exec(`DELETE FROM servers WHERE url = $1`, url)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// PurgeMailbox deletes every blob stored for userId, expired or not.
+func (s *PostgresStorage) PurgeMailbox(userId string) (int64, error) {
+	res, err := s.Db.Exec(`DELETE FROM data WHERE recipient = $1`, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := s.Db.Exec(`DELETE FROM data_acks WHERE recipient = $1`, userId); err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Devices
+
+func (s *PostgresStorage) AddDevice(userId string, deviceId string, publicKey []byte, createdAt int64) error {
+	_, err := s.Db.Exec(`INSERT INTO devices (user_id, id, public_key, created_at) VALUES ($1, $2, $3, $4)`, userId, deviceId, publicKey, createdAt)
+	return err
+}
+
+// GetDevicePublicKey returns nil if the device is not registered to the user.
+func (s *PostgresStorage) GetDevicePublicKey(userId string, deviceId string) ([]byte, error) {
+	var publicKey []byte
+	err := s.Db.QueryRow(`SELECT public_key FROM devices WHERE user_id = $1 AND id = $2`, userId, deviceId).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return publicKey, err
+}
+
+func (s *PostgresStorage) ListDevices(userId string) ([]storage.Device, error) {
+	rows, err := s.Db.Query(`SELECT id, public_key, created_at FROM devices WHERE user_id = $1 ORDER BY created_at, id`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []storage.Device
+	for rows.Next() {
+		var device storage.Device
+		if err := rows.Scan(&device.Id, &device.PublicKey, &device.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// RemoveDevice returns false if the device was not registered to the user.
+func (s *PostgresStorage) RemoveDevice(userId string, deviceId string) (bool, error) {
+	res, err := s.Db.Exec(`DELETE FROM devices WHERE user_id = $1 AND id = $2`, userId, deviceId)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// Shared methods by UserStorage and DataStorage
+
+func (s *PostgresStorage) CheckUserIdExists(id string) (bool, error) {
+	var exists bool
+	row := s.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, id)
+	if err := row.Scan(&exists); err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+// HealthCheck pings the database.
+func (s *PostgresStorage) HealthCheck(ctx context.Context) error {
+	return s.Db.PingContext(ctx)
+}
+
+func (s *PostgresStorage) ExitCleanup() error {
+	return s.Db.Close()
+}
@@ -1,11 +1,244 @@
 package redis
 
 import (
-	"bytes"
+	"cmp"
 	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/constants"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
 	"github.com/redis/go-redis/v9"
 )
 
+// Key layout used for UserStorage, data lists are keyed by the bare recipient ID.
+const (
+	usersKey              = "users"                 // hash: user id -> public key
+	userPublicKeysKey     = "user_public_keys"      // hash: public key -> user id, enforces uniqueness
+	serverKeyPrefix       = "server:"               // hash per federated server: public_key, refetch_date
+	challengeKeyPrefix    = "challenge:"            // hash per challenge: id or public_key, expires natively
+	revokedTokenPrefix    = "revoked_token:"        // string per revoked token ID, expires natively with the token
+	tokensRevokedKey      = "tokens_revoked_before" // hash: user id -> unix milliseconds before which tokens are revoked
+	bannedUsersKey        = "banned_users"          // hash: user id -> unix time of the ban
+	reservedIdPrefix      = "reserved_user_id:"     // string per deleted user ID, expires natively with the reuse cooldown
+	devicesPrefix         = "devices:"              // hash per user: device id -> public key
+	deviceCreatedAtPrefix = "devices_created_at:"   // hash per user: device id -> unix time of the registration
+	devicePublicKeysKey   = "device_public_keys"    // hash: public key -> user id, enforces uniqueness
+)
+
+// deleteUserScript deletes a user along with its devices and reserves its ID, if the user exists.
+var deleteUserScript = redis.NewScript(`
+local publicKey = redis.call('HGET', KEYS[1], ARGV[1])
+if not publicKey then
+    return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], publicKey)
+for _, devicePublicKey in ipairs(redis.call('HVALS', KEYS[4])) do
+    redis.call('HDEL', KEYS[3], devicePublicKey)
+end
+redis.call('DEL', KEYS[4], KEYS[5])
+redis.call('HDEL', KEYS[6], ARGV[1])
+redis.call('HDEL', KEYS[7], ARGV[1])
+redis.call('SET', KEYS[8], 1)
+redis.call('EXPIREAT', KEYS[8], ARGV[2])
+return 1
+`)
+
+// updatePublicKeyScript swaps a user's public-key if it is still the expected one, and the new one isn't registered yet.
+var updatePublicKeyScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= ARGV[2] then
+    return 0
+end
+if redis.call('HSETNX', KEYS[2], ARGV[3], ARGV[1]) == 0 then
+    return redis.error_reply('Public-key is already registered to another user')
+end
+redis.call('HDEL', KEYS[2], ARGV[2])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+return 1
+`)
+
+// dataExpiryKey is a sorted set of "recipient:hex(ack id)" scored by expiry, used to purge individual blobs.
+const dataExpiryKey = "data_expiry"
+
+// dataAcksPrefix is followed by "recipient:hex(ack id)", a set per blob of the devices that acknowledged it.
+const dataAcksPrefix = "data_acks:"
+
+// Usage of each mailbox, and of every mailbox together, is kept up to date by the scripts that modify mailboxes.
+const (
+	mailboxUsagePrefix   = "mailbox_usage:"      // hash per user: bytes, count of its undelivered blobs
+	dataUsageKey         = "data_usage"          // hash: bytes, count of every undelivered blob
+	dataUsageMigratedKey = "data_usage_migrated" // set once every mailbox stored by older versions was measured
+)
+
+// mailboxLua is shared by the scripts modifying a mailbox, called with KEYS being mailboxKeys and ARGV[1] the ack ID length.
+// Mailboxes stored before usage was counted are measured on first use, and stop expiring natively as that would
+// leave their blobs counted.
+const mailboxLua = `
+local ackIdLen = tonumber(ARGV[1])
+
+local function addUsage(bytes, count)
+    redis.call('HINCRBY', KEYS[3], 'bytes', bytes)
+    redis.call('HINCRBY', KEYS[3], 'count', count)
+    redis.call('HINCRBY', KEYS[4], 'bytes', bytes)
+    redis.call('HINCRBY', KEYS[4], 'count', count)
+end
+
+if redis.call('EXISTS', KEYS[3]) == 0 then
+    local bytes, count = 0, 0
+    for _, v in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+        bytes = bytes + #v - ackIdLen
+        count = count + 1
+    end
+    redis.call('PERSIST', KEYS[1])
+    redis.call('HSET', KEYS[3], 'bytes', 0, 'count', 0)
+    addUsage(bytes, count)
+end
+
+local function tohex(s)
+    return (s:gsub('.', function(c) return string.format('%02x', string.byte(c)) end))
+end
+
+-- removeBlobs deletes the blobs whose ack ID is a key of acks, along with the expiry and acknowledgements of every ack ID.
+local function removeBlobs(userId, acksPrefix, acks)
+    local bytes, count = 0, 0
+    for _, v in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+        if acks[string.sub(v, 1, ackIdLen)] then
+            local removed = redis.call('LREM', KEYS[1], 0, v)
+            bytes = bytes + removed * (#v - ackIdLen)
+            count = count + removed
+        end
+    end
+    -- Negating a zero would pass -0, which HINCRBY rejects.
+    addUsage(0 - bytes, 0 - count)
+
+    for ackId in pairs(acks) do
+        local member = userId .. ':' .. tohex(ackId)
+        redis.call('ZREM', KEYS[2], member)
+        redis.call('DEL', acksPrefix .. member)
+    end
+    return count
+end
+`
+
+// insertDataScript appends a blob to the recipient's mailbox, and schedules its expiry if it has one.
+// It returns 0 without storing the blob if it would exceed the quota, ARGV[5] bytes and ARGV[6] blobs.
+var insertDataScript = redis.NewScript(mailboxLua + `
+local size = #ARGV[2] - ackIdLen
+local maxBytes, maxMessages = tonumber(ARGV[5]), tonumber(ARGV[6])
+local usage = redis.call('HMGET', KEYS[3], 'bytes', 'count')
+if (maxMessages > 0 and tonumber(usage[2]) >= maxMessages) or (maxBytes > 0 and tonumber(usage[1]) + size > maxBytes) then
+    return 0
+end
+
+redis.call('RPUSH', KEYS[1], ARGV[2])
+if tonumber(ARGV[3]) ~= 0 then
+    redis.call('ZADD', KEYS[2], ARGV[3], ARGV[4])
+end
+addUsage(size, 1)
+return 1
+`)
+
+// deleteBlobsScript deletes the blobs of user ARGV[2] whose ack IDs follow ARGV[3], the acknowledgements key prefix.
+var deleteBlobsScript = redis.NewScript(mailboxLua + `
+local acks = {}
+for i = 4, #ARGV do
+    acks[ARGV[i]] = true
+end
+return removeBlobs(ARGV[2], ARGV[3], acks)
+`)
+
+// ackBlobsScript records that device ARGV[4] acknowledged the blobs of user ARGV[2] whose ack IDs follow ARGV[5],
+// and deletes those acknowledged by at least ARGV[5] devices. ARGV[3] is the acknowledgements key prefix.
+var ackBlobsScript = redis.NewScript(mailboxLua + `
+local userId, acksPrefix, deviceId, requiredAcks = ARGV[2], ARGV[3], ARGV[4], tonumber(ARGV[5])
+local wanted = {}
+for i = 6, #ARGV do
+    wanted[ARGV[i]] = true
+end
+
+-- Only blobs still in the mailbox get an acknowledgement set.
+local acked = {}
+for _, v in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+    local ackId = string.sub(v, 1, ackIdLen)
+    if wanted[ackId] then
+        local key = acksPrefix .. userId .. ':' .. tohex(ackId)
+        redis.call('SADD', key, deviceId)
+        if redis.call('SCARD', key) >= requiredAcks then
+            acked[ackId] = true
+        end
+    end
+end
+return removeBlobs(userId, acksPrefix, acked)
+`)
+
+// removeDeviceAcksScript forgets the acknowledgements of device ARGV[4] for every blob of user ARGV[2], and deletes
+// the blobs still acknowledged by at least ARGV[5] devices. ARGV[3] is the acknowledgements key prefix.
+var removeDeviceAcksScript = redis.NewScript(mailboxLua + `
+local userId, acksPrefix, deviceId, requiredAcks = ARGV[2], ARGV[3], ARGV[4], tonumber(ARGV[5])
+
+local acked = {}
+for _, v in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+    local ackId = string.sub(v, 1, ackIdLen)
+    local key = acksPrefix .. userId .. ':' .. tohex(ackId)
+    redis.call('SREM', key, deviceId)
+    if redis.call('SCARD', key) >= requiredAcks then
+        acked[ackId] = true
+    end
+end
+return removeBlobs(userId, acksPrefix, acked)
+`)
+
+// mailboxUsageScript returns the size, without the ack ID prefixes, and number of blobs in a mailbox.
+var mailboxUsageScript = redis.NewScript(mailboxLua + `
+local usage = redis.call('HMGET', KEYS[3], 'bytes', 'count')
+return {tonumber(usage[1]), tonumber(usage[2])}
+`)
+
+// purgeMailboxScript deletes a whole mailbox and its usage, and returns how many blobs it held.
+var purgeMailboxScript = redis.NewScript(mailboxLua + `
+local usage = redis.call('HMGET', KEYS[3], 'bytes', 'count')
+redis.call('DEL', KEYS[1], KEYS[3])
+redis.call('HINCRBY', KEYS[4], 'bytes', 0 - tonumber(usage[1]))
+redis.call('HINCRBY', KEYS[4], 'count', 0 - tonumber(usage[2]))
+return tonumber(usage[2])
+`)
+
+// mailboxKeys returns the keys every mailbox script is called with.
+func mailboxKeys(userId string) []string {
+	return []string{userId, dataExpiryKey, mailboxUsagePrefix + userId, dataUsageKey}
+}
+
+// Key layout used for the outbound federation queue.
+const (
+	outboundIdKey     = "outbound_next_id" // counter for outbound message IDs
+	outboundDueKey    = "outbound_due"     // sorted set: message id scored by next attempt
+	outboundKeyPrefix = "outbound:"        // hash per message
+)
+
+// federationSeenPrefix is followed by "url:hex(message id)", a string per received federation message,
+// expiring natively once the sender can no longer retry it.
+const federationSeenPrefix = "federation_seen:"
+
+// claimOutboundScript reschedules a queued message only if its next attempt is still the one we fetched.
+var claimOutboundScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if not score or tonumber(score) ~= tonumber(ARGV[2]) then
+    return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+redis.call('HSET', KEYS[2], 'attempts', ARGV[4])
+return 1
+`)
+
+// NotifyChannel is the pub/sub channel used to fan-out new data notifications, the payload is the recipient ID.
+const NotifyChannel = "coldwire_data"
+
 type RedisStorage struct {
 	client *redis.Client
 }
@@ -22,11 +255,252 @@ func New(addr string, port string, password string, db int) (*RedisStorage, erro
 		return nil, err
 	}
 
-	return &RedisStorage{client: rdb}, nil
+	// Our scripts build keys of a user's acks and blobs from prefixes instead of receiving them all in KEYS,
+	// which only works when every key lives on the same server.
+	info, err := rdb.Info(context.Background(), "cluster").Result()
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(info, "cluster_enabled:1") {
+		return nil, errors.New("Redis Cluster is not supported, use a standalone Redis server")
+	}
+
+	s := &RedisStorage{client: rdb}
+	if err := s.migrateUsage(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrateUsage measures, once, every mailbox stored before usage was counted, so the total usage includes them
+// before they are next modified. Mailboxes are the only lists we store, so they are found by key type.
+func (s *RedisStorage) migrateUsage() error {
+	ctx := context.Background()
+
+	migrated, err := s.client.Exists(ctx, dataUsageMigratedKey).Result()
+	if err != nil || migrated > 0 {
+		return err
+	}
+
+	iter := s.client.ScanType(ctx, 0, "*", 1000, "list").Iterator()
+	for iter.Next(ctx) {
+		if err := mailboxUsageScript.Run(ctx, s.client, mailboxKeys(iter.Val()), constants.ACK_ID_LEN).Err(); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return s.client.Set(ctx, dataUsageMigratedKey, 1, 0).Err()
+}
+
+// Implement UserStorage interface
+func (s *RedisStorage) SaveUser(id string, publicKey []byte) error {
+	ctx := context.Background()
+
+	ok, err := s.client.HSetNX(ctx, userPublicKeysKey, string(publicKey), id).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Public-key is already registered to another user")
+	}
+
+	ok, err = s.client.HSetNX(ctx, usersKey, id, publicKey).Result()
+	if err != nil || !ok {
+		// Undo the reservation of the public-key, so it can be registered again.
+		s.client.HDel(ctx, userPublicKeysKey, string(publicKey))
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("User (%s) already exists", id)
+	}
+
+	return nil
+}
+
+// UpdateUserPublicKey replaces the user's public-key, only if it is still oldPublicKey.
+func (s *RedisStorage) UpdateUserPublicKey(id string, oldPublicKey []byte, newPublicKey []byte) (bool, error) {
+	updated, err := updatePublicKeyScript.Run(context.Background(), s.client,
+		[]string{usersKey, userPublicKeysKey},
+		id, oldPublicKey, newPublicKey,
+	).Int()
+	return updated == 1, err
+}
+
+func (s *RedisStorage) GetUserPublicKeyById(id string) ([]byte, error) {
+	publicKey, err := s.client.HGet(context.Background(), usersKey, id).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return publicKey, nil
+}
+
+func (s *RedisStorage) SaveChallenge(challenge []byte, id interface{}, publicKey interface{}, createdAt int64, expiresAt int64) error {
+	ctx := context.Background()
+	key := challengeKeyPrefix + hex.EncodeToString(challenge)
+
+	fields := map[string]interface{}{"created_at": createdAt}
+	if id != nil {
+		fields["id"] = id
+	}
+	if publicKey != nil {
+		fields["public_key"] = publicKey
+	}
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, fields)
+		pipe.ExpireAt(ctx, key, time.Unix(expiresAt, 0))
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStorage) SaveServerInfo(url string, publicKey []byte, refetchDate string) error {
+	return s.client.HSet(context.Background(), serverKeyPrefix+url, "public_key", publicKey, "refetch_date", refetchDate).Err()
+}
+
+func (s *RedisStorage) GetServerInfo(url string) ([]byte, string, error) {
+	values, err := s.client.HMGet(context.Background(), serverKeyPrefix+url, "public_key", "refetch_date").Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	publicKey, ok := values[0].(string)
+	if !ok {
+		return nil, "", nil
+	}
+
+	refetchDate, _ := values[1].(string)
+
+	return []byte(publicKey), refetchDate, nil
+}
+
+// ConsumeChallenge reads and deletes the challenge in one transaction, so a challenge
+// can only ever be verified once. Expiry is left to Redis key expiration.
+// Challenges issued for one of the user's devices carry the device's key.
+func (s *RedisStorage) ConsumeChallenge(challenge []byte, now int64) ([]byte, string, error) {
+	ctx := context.Background()
+	key := challengeKeyPrefix + hex.EncodeToString(challenge)
+
+	var get *redis.SliceCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HMGet(ctx, key, "id", "public_key")
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	values := get.Val()
+
+	userId, hasUserId := values[0].(string)
+	publicKey, hasPublicKey := values[1].(string)
+
+	if hasUserId && hasPublicKey {
+		return []byte(publicKey), userId, nil
+	} else if hasUserId {
+		fetchedPublicKey, err := s.GetUserPublicKeyById(userId)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return fetchedPublicKey, userId, nil
+	} else if hasPublicKey {
+		return []byte(publicKey), "", nil
+	} else {
+		return nil, "", storage.ErrChallengeNotFound
+	}
+}
+
+func (s *RedisStorage) CleanupChallenges() error {
+	ctx := context.Background()
+
+	iter := s.client.Scan(ctx, 0, challengeKeyPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		if err := s.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
+}
+
+// PurgeExpiredChallenges is a no-op, challenge keys expire on their own.
+func (s *RedisStorage) PurgeExpiredChallenges(now int64) (int64, error) {
+	return 0, nil
+}
+
+// RevokeToken adds jti to the revocation list, it returns false if it was already revoked.
+func (s *RedisStorage) RevokeToken(jti string, expiresAt int64) (bool, error) {
+	err := s.client.SetArgs(context.Background(), revokedTokenPrefix+jti, 1, redis.SetArgs{
+		Mode:     "NX",
+		ExpireAt: time.Unix(expiresAt, 0),
+	}).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// RevokeUserTokens revokes every token of userId issued before issuedBefore, in Unix milliseconds.
+func (s *RedisStorage) RevokeUserTokens(userId string, issuedBefore int64) error {
+	return s.client.HSet(context.Background(), tokensRevokedKey, userId, issuedBefore).Err()
+}
+
+// IsTokenRevoked also reports tokens of deleted users as revoked.
+func (s *RedisStorage) IsTokenRevoked(jti string, userId string, issuedAt int64) (bool, error) {
+	ctx := context.Background()
+
+	var (
+		exists     *redis.IntCmd
+		userExists *redis.BoolCmd
+		before     *redis.StringCmd
+	)
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		exists = pipe.Exists(ctx, revokedTokenPrefix+jti)
+		userExists = pipe.HExists(ctx, usersKey, userId)
+		before = pipe.HGet(ctx, tokensRevokedKey, userId)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+
+	if exists.Val() > 0 || !userExists.Val() {
+		return true, nil
+	}
+
+	if before.Err() == redis.Nil {
+		return false, nil
+	}
+
+	issuedBefore, err := before.Int64()
+	if err != nil {
+		return false, err
+	}
+
+	return issuedAt < issuedBefore, nil
+}
+
+// PurgeExpiredRevocations is a no-op, revoked token keys expire on their own.
+func (s *RedisStorage) PurgeExpiredRevocations(now int64) (int64, error) {
+	return 0, nil
 }
 
 // / Implements DataStorage interface
-func (s *RedisStorage) GetLatestData(userId string) ([]byte, error) {
+func (s *RedisStorage) GetLatestData(userId string, deviceId string) ([]byte, error) {
 	ctx := context.Background()
 
 	result, err := s.client.LRange(ctx, userId, 0, -1).Result()
@@ -34,38 +508,537 @@ func (s *RedisStorage) GetLatestData(userId string) ([]byte, error) {
 		return nil, err
 	}
 
+	acked := make([]*redis.BoolCmd, len(result))
+	expiries := make([]*redis.FloatCmd, len(result))
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, value := range result {
+			ackId := []byte(value[:constants.ACK_ID_LEN])
+			acked[i] = pipe.SIsMember(ctx, dataAcksKey(userId, ackId), deviceId)
+			expiries[i] = pipe.ZScore(ctx, dataExpiryKey, expiryMember(userId, ackId))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// Expired blobs stay in the list until the janitor purges them, they must not be delivered in the meantime.
+	now := float64(time.Now().Unix())
+
 	var allData []byte
-	for _, value := range result {
+	for i, value := range result {
+		if acked[i].Val() {
+			continue
+		}
+		if expiresAt, err := expiries[i].Result(); err == nil && expiresAt <= now {
+			continue
+		}
 		allData = append(allData, []byte(value)...)
 	}
 
 	return allData, nil
 }
 
-func (s *RedisStorage) DeleteAck(userId string, acks [][]byte) error {
+// DeleteAck records the device's acknowledgements, and deletes the blobs acknowledged by at least requiredAcks devices.
+func (s *RedisStorage) DeleteAck(userId string, deviceId string, acks [][]byte, requiredAcks int) error {
+	if requiredAcks <= 1 {
+		return s.deleteBlobs(userId, acks)
+	}
+
+	if len(acks) == 0 {
+		return nil
+	}
+
+	args := []interface{}{constants.ACK_ID_LEN, userId, dataAcksPrefix, deviceId, requiredAcks}
+	for _, ackId := range acks {
+		args = append(args, ackId)
+	}
+
+	return ackBlobsScript.Run(context.Background(), s.client, mailboxKeys(userId), args...).Err()
+}
+
+// RemoveDeviceAcks forgets the acknowledgements of a removed device, and deletes the blobs
+// that the remaining devices all acknowledged already.
+func (s *RedisStorage) RemoveDeviceAcks(userId string, deviceId string, requiredAcks int) error {
+	return removeDeviceAcksScript.Run(context.Background(), s.client, mailboxKeys(userId),
+		constants.ACK_ID_LEN, userId, dataAcksPrefix, deviceId, max(requiredAcks, 1)).Err()
+}
+
+// deleteBlobs removes the blobs with the given ack IDs from the mailbox, along with their expiry and acknowledgements.
+func (s *RedisStorage) deleteBlobs(userId string, acks [][]byte) error {
+	if len(acks) == 0 {
+		return nil
+	}
+
+	args := []interface{}{constants.ACK_ID_LEN, userId, dataAcksPrefix}
+	for _, ackId := range acks {
+		args = append(args, ackId)
+	}
+
+	return deleteBlobsScript.Run(context.Background(), s.client, mailboxKeys(userId), args...).Err()
+}
+
+// InsertData stores the blob unless it would exceed quota, checked against the mailbox usage in the same script.
+func (s *RedisStorage) InsertData(dataBlob []byte, ackId []byte, recipientId string, expiresAt int64, quota storage.MailboxQuota) error {
+	dataBlob = append(ackId, dataBlob...)
+	inserted, err := insertDataScript.Run(context.Background(), s.client, mailboxKeys(recipientId),
+		constants.ACK_ID_LEN, dataBlob, expiresAt, expiryMember(recipientId, ackId), quota.MaxBytes, quota.MaxMessages,
+	).Int()
+	if err != nil {
+		return err
+	}
+
+	if inserted == 0 {
+		return fmt.Errorf("%w: (%s)", storage.ErrMailboxFull, recipientId)
+	}
+	return nil
+}
+
+// PurgeExpiredData removes blobs whose expiry has passed.
+func (s *RedisStorage) PurgeExpiredData(now int64) (int64, error) {
+	ctx := context.Background()
+
+	members, err := s.client.ZRangeByScore(ctx, dataExpiryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	acksByUser := make(map[string][][]byte)
+	for _, member := range members {
+		userId, ackIdHex, ok := strings.Cut(member, ":")
+		if !ok {
+			continue
+		}
+
+		ackId, err := hex.DecodeString(ackIdHex)
+		if err != nil {
+			continue
+		}
+
+		acksByUser[userId] = append(acksByUser[userId], ackId)
+	}
+
+	for userId, acks := range acksByUser {
+		if err := s.deleteBlobs(userId, acks); err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(members)), nil
+}
+
+// GetMailboxUsage returns the size and number of undelivered blobs stored for userId.
+func (s *RedisStorage) GetMailboxUsage(userId string) (int64, int64, error) {
+	usage, err := mailboxUsageScript.Run(context.Background(), s.client, mailboxKeys(userId), constants.ACK_ID_LEN).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return usage[0], usage[1], nil
+}
+
+// GetTotalUsage returns the size and number of undelivered blobs stored for every user.
+func (s *RedisStorage) GetTotalUsage() (int64, int64, error) {
+	usage, err := s.client.HMGet(context.Background(), dataUsageKey, "bytes", "count").Result()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	totalBytes, _ := strconv.ParseInt(fmt.Sprint(usage[0]), 10, 64)
+	count, _ := strconv.ParseInt(fmt.Sprint(usage[1]), 10, 64)
+	return totalBytes, count, nil
+}
+
+func expiryMember(userId string, ackId []byte) string {
+	return userId + ":" + hex.EncodeToString(ackId)
+}
+
+func dataAcksKey(userId string, ackId []byte) string {
+	return dataAcksPrefix + expiryMember(userId, ackId)
+}
+
+func (s *RedisStorage) EnqueueOutbound(msg storage.OutboundMessage) error {
 	ctx := context.Background()
-	values, err := s.client.LRange(ctx, userId, 0, -1).Result()
+
+	id, err := s.client.Incr(ctx, outboundIdKey).Result()
 	if err != nil {
 		return err
 	}
 
-	for _, v := range values {
-		data := []byte(v)
+	key := outboundKeyPrefix + strconv.FormatInt(id, 10)
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key,
+			"url", msg.Url,
+			"sender", msg.Sender,
+			"recipient", msg.Recipient,
+			"data_blob", msg.Blob,
+			"message_id", msg.MessageId,
+			"created_at", msg.CreatedAt,
+			"attempts", msg.Attempts,
+		)
+		pipe.ZAdd(ctx, outboundDueKey, redis.Z{Score: float64(msg.NextAttempt), Member: id})
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStorage) GetDueOutbound(now int64, limit int) ([]storage.OutboundMessage, error) {
+	ctx := context.Background()
+
+	due, err := s.client.ZRangeByScoreWithScores(ctx, outboundDueKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []storage.OutboundMessage
+	for _, z := range due {
+		idString, _ := z.Member.(string)
+		id, err := strconv.ParseInt(idString, 10, 64)
+		if err != nil {
+			return nil, err
+		}
 
-		for _, ackId := range acks {
-			if bytes.HasPrefix(data, ackId) {
-				if err := s.client.LRem(ctx, userId, 0, v).Err(); err != nil {
-					return err
-				}
-				break
+		fields, err := s.client.HGetAll(ctx, outboundKeyPrefix+idString).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		// Deleted by another worker in the meantime
+		if len(fields) == 0 {
+			continue
+		}
+
+		createdAt, _ := strconv.ParseInt(fields["created_at"], 10, 64)
+		attempts, _ := strconv.Atoi(fields["attempts"])
+
+		msgs = append(msgs, storage.OutboundMessage{
+			Id:          id,
+			Url:         fields["url"],
+			Sender:      fields["sender"],
+			Recipient:   fields["recipient"],
+			Blob:        []byte(fields["data_blob"]),
+			MessageId:   []byte(fields["message_id"]),
+			CreatedAt:   createdAt,
+			Attempts:    attempts,
+			NextAttempt: int64(z.Score),
+		})
+	}
+
+	return msgs, nil
+}
+
+// ClaimOutbound reschedules the message only if nobody else did since we fetched it,
+// so that concurrent workers never deliver the same message twice.
+func (s *RedisStorage) ClaimOutbound(id int64, nextAttempt int64, attempts int, retryAt int64) (bool, error) {
+	idString := strconv.FormatInt(id, 10)
+	claimed, err := claimOutboundScript.Run(context.Background(), s.client,
+		[]string{outboundDueKey, outboundKeyPrefix + idString},
+		idString, nextAttempt, retryAt, attempts,
+	).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return claimed == 1, nil
+}
+
+func (s *RedisStorage) DeleteOutbound(id int64) error {
+	ctx := context.Background()
+	idString := strconv.FormatInt(id, 10)
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, outboundDueKey, idString)
+		pipe.Del(ctx, outboundKeyPrefix+idString)
+		return nil
+	})
+	return err
+}
+
+// MarkFederationMessageSeen records a message received from url, and returns false if it was already recorded.
+func (s *RedisStorage) MarkFederationMessageSeen(url string, messageId []byte, expiresAt int64) (bool, error) {
+	err := s.client.SetArgs(context.Background(), federationSeenPrefix+url+":"+hex.EncodeToString(messageId), 1, redis.SetArgs{
+		Mode:     "NX",
+		ExpireAt: time.Unix(expiresAt, 0),
+	}).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// UnmarkFederationMessageSeen forgets a message that could not be stored, so that its retry is accepted.
+func (s *RedisStorage) UnmarkFederationMessageSeen(url string, messageId []byte) error {
+	return s.client.Del(context.Background(), federationSeenPrefix+url+":"+hex.EncodeToString(messageId)).Err()
+}
+
+// PurgeExpiredFederationMessages is a no-op, seen message keys expire on their own.
+func (s *RedisStorage) PurgeExpiredFederationMessages(now int64) (int64, error) {
+	return 0, nil
+}
+
+// Implements Notifier interface
+func (s *RedisStorage) Publish(recipientId string) error {
+	return s.client.Publish(context.Background(), NotifyChannel, recipientId).Err()
+}
+
+func (s *RedisStorage) Listen(ctx context.Context, onNotify func(recipientId string)) error {
+	pubsub := s.client.Subscribe(ctx, NotifyChannel)
+	defer pubsub.Close()
+
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-ch:
+			if !ok {
+				return errors.New("Redis pub/sub channel closed")
 			}
+			onNotify(msg.Payload)
 		}
 	}
-	return nil
 }
-func (s *RedisStorage) InsertData(dataBlob []byte, ackId []byte, recipientId string) error {
-	dataBlob = append(ackId, dataBlob...)
-	return s.client.RPush(context.Background(), recipientId, dataBlob).Err()
+
+// Administration
+
+func (s *RedisStorage) ListUsers() ([]string, error) {
+	ids, err := s.client.HKeys(context.Background(), usersKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// DeleteUser deletes the user and its devices and frees their public-keys, and keeps its ID from being reissued until reservedUntil.
+// It returns false if the user did not exist. Its pending challenges expire on their own, and can't be verified without the user.
+func (s *RedisStorage) DeleteUser(id string, reservedUntil int64) (bool, error) {
+	deleted, err := deleteUserScript.Run(context.Background(), s.client,
+		[]string{usersKey, userPublicKeysKey, devicePublicKeysKey, devicesPrefix + id, deviceCreatedAtPrefix + id,
+			tokensRevokedKey, bannedUsersKey, reservedIdPrefix + id},
+		id, reservedUntil).Int()
+	return deleted == 1, err
+}
+
+// IsUserIdReserved reports whether id belonged to a user deleted less than the reuse cooldown ago.
+func (s *RedisStorage) IsUserIdReserved(id string, now int64) (bool, error) {
+	exists, err := s.client.Exists(context.Background(), reservedIdPrefix+id).Result()
+	return exists > 0, err
+}
+
+// PurgeExpiredReservations is a no-op, reserved ID keys expire on their own.
+func (s *RedisStorage) PurgeExpiredReservations(now int64) (int64, error) {
+	return 0, nil
+}
+
+// SetUserBan bans the user since bannedAt, or lifts the ban if bannedAt is 0. It returns false if the user does not exist.
+func (s *RedisStorage) SetUserBan(id string, bannedAt int64) (bool, error) {
+	ctx := context.Background()
+
+	exists, err := s.client.HExists(ctx, usersKey, id).Result()
+	if err != nil || !exists {
+		return false, err
+	}
+
+	if bannedAt == 0 {
+		return true, s.client.HDel(ctx, bannedUsersKey, id).Err()
+	}
+	return true, s.client.HSet(ctx, bannedUsersKey, id, bannedAt).Err()
+}
+
+// GetUserBan returns when the user was banned, 0 if it isn't.
+func (s *RedisStorage) GetUserBan(id string) (int64, error) {
+	bannedAt, err := s.client.HGet(context.Background(), bannedUsersKey, id).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return bannedAt, err
+}
+
+func (s *RedisStorage) ListServers() ([]storage.ServerInfo, error) {
+	ctx := context.Background()
+
+	var servers []storage.ServerInfo
+	iter := s.client.Scan(ctx, 0, serverKeyPrefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		url := strings.TrimPrefix(iter.Val(), serverKeyPrefix)
+
+		publicKey, refetchDate, err := s.GetServerInfo(url)
+		if err != nil {
+			return nil, err
+		}
+		if publicKey == nil {
+			continue
+		}
+
+		servers = append(servers, storage.ServerInfo{Url: url, PublicKey: publicKey, RefetchDate: refetchDate})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(servers, func(a, b storage.ServerInfo) int { return strings.Compare(a.Url, b.Url) })
+	return servers, nil
+}
+
+// DeleteServerInfo forgets a federated server's key, it is fetched again on its next request.
+func (s *RedisStorage) DeleteServerInfo(url string) (bool, error) {
+	deleted, err := s.client.Del(context.Background(), serverKeyPrefix+url).Result()
+	return deleted > 0, err
+}
+
+// PurgeMailbox deletes every blob stored for userId, expired or not.
+func (s *RedisStorage) PurgeMailbox(userId string) (int64, error) {
+	ctx := context.Background()
+
+	var members []string
+	iter := s.client.ZScan(ctx, dataExpiryKey, 0, userId+":*", 0).Iterator()
+	for i := 0; iter.Next(ctx); i++ {
+		// ZSCAN returns members and scores alternately.
+		if i%2 == 0 {
+			members = append(members, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+
+	var ackKeys []string
+	ackIter := s.client.Scan(ctx, 0, dataAcksPrefix+userId+":*", 0).Iterator()
+	for ackIter.Next(ctx) {
+		ackKeys = append(ackKeys, ackIter.Val())
+	}
+	if err := ackIter.Err(); err != nil {
+		return 0, err
+	}
+
+	count, err := purgeMailboxScript.Run(ctx, s.client, mailboxKeys(userId), constants.ACK_ID_LEN).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, member := range members {
+			pipe.ZRem(ctx, dataExpiryKey, member)
+		}
+		for _, key := range ackKeys {
+			pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// Devices
+
+func (s *RedisStorage) AddDevice(userId string, deviceId string, publicKey []byte, createdAt int64) error {
+	ctx := context.Background()
+
+	ok, err := s.client.HSetNX(ctx, devicePublicKeysKey, string(publicKey), userId).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("Public-key is already registered to another device")
+	}
+
+	ok, err = s.client.HSetNX(ctx, devicesPrefix+userId, deviceId, publicKey).Result()
+	if err != nil || !ok {
+		// Undo the reservation of the public-key, so it can be registered again.
+		s.client.HDel(ctx, devicePublicKeysKey, string(publicKey))
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Device (%s) of user (%s) already exists", deviceId, userId)
+	}
+
+	return s.client.HSet(ctx, deviceCreatedAtPrefix+userId, deviceId, createdAt).Err()
+}
+
+// GetDevicePublicKey returns nil if the device is not registered to the user.
+func (s *RedisStorage) GetDevicePublicKey(userId string, deviceId string) ([]byte, error) {
+	publicKey, err := s.client.HGet(context.Background(), devicesPrefix+userId, deviceId).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return publicKey, err
+}
+
+func (s *RedisStorage) ListDevices(userId string) ([]storage.Device, error) {
+	ctx := context.Background()
+
+	var publicKeys, createdAt *redis.MapStringStringCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		publicKeys = pipe.HGetAll(ctx, devicesPrefix+userId)
+		createdAt = pipe.HGetAll(ctx, deviceCreatedAtPrefix+userId)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []storage.Device
+	for id, publicKey := range publicKeys.Val() {
+		created, _ := strconv.ParseInt(createdAt.Val()[id], 10, 64)
+		devices = append(devices, storage.Device{Id: id, PublicKey: []byte(publicKey), CreatedAt: created})
+	}
+
+	slices.SortFunc(devices, func(a, b storage.Device) int {
+		return cmp.Or(cmp.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.Id, b.Id))
+	})
+	return devices, nil
+}
+
+// RemoveDevice returns false if the device was not registered to the user.
+func (s *RedisStorage) RemoveDevice(userId string, deviceId string) (bool, error) {
+	ctx := context.Background()
+
+	publicKey, err := s.client.HGet(ctx, devicesPrefix+userId, deviceId).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, devicesPrefix+userId, deviceId)
+		pipe.HDel(ctx, deviceCreatedAtPrefix+userId, deviceId)
+		pipe.HDel(ctx, devicePublicKeysKey, publicKey)
+		return nil
+	})
+	return err == nil, err
+}
+
+// Shared methods by UserStorage and DataStorage
+
+func (s *RedisStorage) CheckUserIdExists(id string) (bool, error) {
+	return s.client.HExists(context.Background(), usersKey, id).Result()
+}
+
+// HealthCheck sends a PING to Redis.
+func (s *RedisStorage) HealthCheck(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
 }
 
 func (s *RedisStorage) ExitCleanup() error {
@@ -1,10 +1,14 @@
 package sqlite
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"log/slog"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
 	isqlite "modernc.org/sqlite"
 	isqlitelib "modernc.org/sqlite/lib"
 	"strings"
@@ -48,6 +52,45 @@ func New(path string) (*SQLiteStorage, error) {
             ack_id BLOB NOT NULL,
             recipient TEXT NOT NULL,
             data_blob MEDIUMBLOB NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS outbound (
+            id INTEGER PRIMARY KEY,
+            url TEXT NOT NULL,
+            sender TEXT NOT NULL,
+            recipient TEXT NOT NULL,
+            data_blob MEDIUMBLOB NOT NULL,
+            message_id BLOB NOT NULL,
+            created_at INTEGER NOT NULL,
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt INTEGER NOT NULL
+        )`,
+		`CREATE INDEX IF NOT EXISTS outbound_next_attempt_idx ON outbound (next_attempt)`,
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+            jti TEXT PRIMARY KEY,
+            expires_at INTEGER NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS reserved_user_ids (
+            id TEXT PRIMARY KEY,
+            reserved_until INTEGER NOT NULL
+        )`,
+		`CREATE TABLE IF NOT EXISTS devices (
+            user_id TEXT NOT NULL,
+            id TEXT NOT NULL,
+            public_key BLOB NOT NULL UNIQUE,
+            created_at INTEGER NOT NULL,
+            PRIMARY KEY (user_id, id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS data_acks (
+            recipient TEXT NOT NULL,
+            ack_id BLOB NOT NULL,
+            device_id TEXT NOT NULL,
+            PRIMARY KEY (recipient, ack_id, device_id)
+        )`,
+		`CREATE TABLE IF NOT EXISTS federation_seen (
+            url TEXT NOT NULL,
+            message_id BLOB NOT NULL,
+            expires_at INTEGER NOT NULL,
+            PRIMARY KEY (url, message_id)
         )`,
 	}
 
@@ -57,9 +100,43 @@ func New(path string) (*SQLiteStorage, error) {
 		}
 	}
 
+	// Columns added after the initial release, so databases created by older versions get them too.
+	columns := []struct{ table, column, definition string }{
+		{"data", "expires_at", "INTEGER"},
+		{"challenges", "created_at", "INTEGER"},
+		{"challenges", "expires_at", "INTEGER"},
+		{"users", "tokens_revoked_before", "INTEGER"},
+		{"users", "banned_at", "INTEGER"},
+	}
+
+	for _, c := range columns {
+		if err := addColumnIfMissing(db, c.table, c.column, c.definition); err != nil {
+			return nil, fmt.Errorf("failed to add column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS data_expires_at_idx ON data (expires_at)`); err != nil {
+		return nil, err
+	}
+
 	return &SQLiteStorage{Db: db}, nil
 }
 
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 // Implement UserStorage interface
 func (s *SQLiteStorage) SaveUser(id string, publicKey []byte) error {
     var err error
@@ -73,6 +150,17 @@ func (s *SQLiteStorage) SaveUser(id string, publicKey []byte) error {
 	return err
 }
 
+// UpdateUserPublicKey replaces the user's public-key, only if it is still oldPublicKey.
+func (s *SQLiteStorage) UpdateUserPublicKey(id string, oldPublicKey []byte, newPublicKey []byte) (bool, error) {
+	res, err := s.execRetry(`UPDATE users SET public_key = ? WHERE id = ? AND public_key = ?`, newPublicKey, id, oldPublicKey)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
 func (s *SQLiteStorage) GetUserPublicKeyById(id string) ([]byte, error) {
 	var (
         publicKey []byte
@@ -96,15 +184,15 @@ func (s *SQLiteStorage) GetUserPublicKeyById(id string) ([]byte, error) {
 	return publicKey, err
 }
 
-func (s *SQLiteStorage) SaveChallenge(challenge []byte, id interface{}, publicKey interface{}) error {
+func (s *SQLiteStorage) SaveChallenge(challenge []byte, id interface{}, publicKey interface{}, createdAt int64, expiresAt int64) error {
 	var err error
-    for {
-        _, err = s.Db.Exec(`INSERT INTO challenges (challenge, id, public_key) VALUES (?, ?, ?)`, challenge, id, publicKey)
-        if isSQLiteBusy(err) {
-            continue
-        }
-        break
-    }
+	for {
+		_, err = s.Db.Exec(`INSERT INTO challenges (challenge, id, public_key, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`, challenge, id, publicKey, createdAt, expiresAt)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
 	return err
 }
 
@@ -147,21 +235,32 @@ func (s *SQLiteStorage) GetServerInfo(url string) ([]byte, string, error) {
 	return publicKey, refetchDate, nil
 }
 
-func (s *SQLiteStorage) GetChallengeData(challenge []byte) ([]byte, string, error) {
+// ConsumeChallenge deletes the challenge and returns its data in a single statement,
+// so a challenge can only ever be verified once. Challenges issued for one of the user's devices carry the device's key.
+func (s *SQLiteStorage) ConsumeChallenge(challenge []byte, now int64) ([]byte, string, error) {
 	var (
 		publicKey []byte
 		userId    sql.NullString
+		err       error
 	)
 
-	err := s.Db.QueryRow("SELECT id, public_key FROM challenges WHERE challenge = ?", challenge).Scan(&userId, &publicKey)
+	for {
+		err = s.Db.QueryRow("DELETE FROM challenges WHERE challenge = ? AND expires_at > ? RETURNING id, public_key", challenge, now).Scan(&userId, &publicKey)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
 	if err != nil {
-        if isSQLiteBusy(err) {
-		    return nil, "", nil
-        }
-        return nil, "", err
+		if err == sql.ErrNoRows {
+			return nil, "", storage.ErrChallengeNotFound
+		}
+		return nil, "", err
 	}
 
-	if userId.Valid {
+	if userId.Valid && publicKey != nil {
+		return publicKey, userId.String, nil
+	} else if userId.Valid {
 		fetchedPublicKey, err := s.GetUserPublicKeyById(userId.String)
 		if err != nil {
 			return nil, "", err
@@ -187,6 +286,123 @@ func (s *SQLiteStorage) CleanupChallenges() error {
 	return err
 }
 
+func (s *SQLiteStorage) PurgeExpiredChallenges(now int64) (int64, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	for {
+		res, err = s.Db.Exec(`DELETE FROM challenges WHERE expires_at IS NULL OR expires_at <= ?`, now)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// RevokeToken adds jti to the revocation list, it returns false if it was already revoked.
+func (s *SQLiteStorage) RevokeToken(jti string, expiresAt int64) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	for {
+		res, err = s.Db.Exec(`INSERT OR IGNORE INTO revoked_tokens (jti, expires_at) VALUES (?, ?)`, jti, expiresAt)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// RevokeUserTokens revokes every token of userId issued before issuedBefore, in Unix milliseconds.
+func (s *SQLiteStorage) RevokeUserTokens(userId string, issuedBefore int64) error {
+	var err error
+	for {
+		_, err = s.Db.Exec(`UPDATE users SET tokens_revoked_before = ? WHERE id = ?`, issuedBefore, userId)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
+	return err
+}
+
+// IsTokenRevoked also reports tokens of deleted users as revoked.
+func (s *SQLiteStorage) IsTokenRevoked(jti string, userId string, issuedAt int64) (bool, error) {
+	var revoked bool
+	err := s.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR NOT EXISTS(SELECT 1 FROM users WHERE id = ? AND (tokens_revoked_before IS NULL OR tokens_revoked_before <= ?))`, jti, userId, issuedAt).Scan(&revoked)
+	return revoked, err
+}
+
+// PurgeExpiredRevocations deletes revoked tokens that would have expired anyway.
+func (s *SQLiteStorage) PurgeExpiredRevocations(now int64) (int64, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	for {
+		res, err = s.Db.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= ?`, now)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// execRetry runs a statement until the database is no longer locked.
+func (s *SQLiteStorage) execRetry(query string, args ...any) (sql.Result, error) {
+	for {
+		res, err := s.Db.Exec(query, args...)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		return res, err
+	}
+}
+
+// inTx runs fn in a transaction, and runs it again from the start while the database is locked.
+func (s *SQLiteStorage) inTx(fn func(tx *sql.Tx) error) error {
+	for {
+		tx, err := s.Db.Begin()
+		if err != nil {
+			if isSQLiteBusy(err) {
+				continue
+			}
+			return err
+		}
+
+		err = fn(tx)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			if isSQLiteBusy(err) {
+				continue
+			}
+		}
+		return err
+	}
+}
+
 func isSQLiteBusy(err error) bool {
 	var se *isqlite.Error
 	if errors.As(err, &se) {
@@ -199,8 +415,8 @@ func isSQLiteBusy(err error) bool {
 }
 
 // / Implements DataStorage interface
-func (s *SQLiteStorage) GetLatestData(userId string) ([]byte, error) {
-	rows, err := s.Db.Query("SELECT data_blob, ack_id FROM data WHERE recipient = ? ORDER BY id", userId)
+func (s *SQLiteStorage) GetLatestData(userId string, deviceId string) ([]byte, error) {
+	rows, err := s.Db.Query("SELECT data_blob, ack_id FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?) AND "+notAckedBy+" ORDER BY id", userId, time.Now().Unix(), deviceId)
 	if err != nil {
 		if isSQLiteBusy(err) {
 			return nil, nil
@@ -234,7 +450,50 @@ func (s *SQLiteStorage) GetLatestData(userId string) ([]byte, error) {
 	return allData, nil
 }
 
-func (s *SQLiteStorage) DeleteAck(userId string, acks [][]byte) error {
+func (s *SQLiteStorage) GetDataSince(userId string, deviceId string, afterId int64) ([]storage.DataRecord, error) {
+	rows, err := s.Db.Query("SELECT id, ack_id, data_blob FROM data WHERE recipient = ? AND id > ? AND (expires_at IS NULL OR expires_at > ?) AND "+notAckedBy+" ORDER BY id", userId, afterId, time.Now().Unix(), deviceId)
+	if err != nil {
+		if isSQLiteBusy(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []storage.DataRecord
+	for rows.Next() {
+		var record storage.DataRecord
+		if err := rows.Scan(&record.Id, &record.AckId, &record.Blob); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	if err := rows.Err(); err != nil {
+		if isSQLiteBusy(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// notAckedBy filters out the blobs already acknowledged by the device given as its only argument.
+const notAckedBy = "NOT EXISTS (SELECT 1 FROM data_acks WHERE data_acks.recipient = data.recipient AND data_acks.ack_id = data.ack_id AND data_acks.device_id = ?)"
+
+// ackCount counts the devices that acknowledged a blob.
+const ackCount = "(SELECT COUNT(*) FROM data_acks WHERE data_acks.recipient = data.recipient AND data_acks.ack_id = data.ack_id)"
+
+// blobDeleted filters the acknowledgements whose blob is gone, they are deleted along with it.
+const blobDeleted = "NOT EXISTS (SELECT 1 FROM data WHERE data.recipient = data_acks.recipient AND data.ack_id = data_acks.ack_id)"
+
+// DeleteAck records the device's acknowledgements, and deletes the blobs acknowledged by at least requiredAcks devices.
+func (s *SQLiteStorage) DeleteAck(userId string, deviceId string, acks [][]byte, requiredAcks int) error {
+	if len(acks) == 0 {
+		return nil
+	}
+
 	placeholders := make([]string, len(acks))
 	args := make([]interface{}, len(acks))
 	for i, v := range acks {
@@ -242,13 +501,137 @@ func (s *SQLiteStorage) DeleteAck(userId string, acks [][]byte) error {
 		args[i] = v
 	}
 
-	args = append([]any{userId}, args...)
+	inAcks := fmt.Sprintf("ack_id IN (%s)", strings.Join(placeholders, ","))
+
+	return s.inTx(func(tx *sql.Tx) error {
+		if requiredAcks <= 1 {
+			if _, err := tx.Exec("DELETE FROM data WHERE recipient = ? AND "+inAcks, append([]any{userId}, args...)...); err != nil {
+				return err
+			}
+		} else {
+			_, err := tx.Exec("INSERT OR IGNORE INTO data_acks (recipient, ack_id, device_id) SELECT recipient, ack_id, ? FROM data WHERE recipient = ? AND "+inAcks, append([]any{deviceId, userId}, args...)...)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("DELETE FROM data WHERE recipient = ? AND "+inAcks+" AND "+ackCount+" >= ?", append(append([]any{userId}, args...), requiredAcks)...)
+			if err != nil {
+				return err
+			}
+		}
 
-	var err error
+		_, err := tx.Exec("DELETE FROM data_acks WHERE recipient = ? AND "+inAcks+" AND "+blobDeleted, append([]any{userId}, args...)...)
+		return err
+	})
+}
+
+// RemoveDeviceAcks forgets the acknowledgements of a removed device, and deletes the blobs
+// that the remaining devices all acknowledged already.
+func (s *SQLiteStorage) RemoveDeviceAcks(userId string, deviceId string, requiredAcks int) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM data_acks WHERE recipient = ? AND device_id = ?`, userId, deviceId); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM data WHERE recipient = ? AND "+ackCount+" >= ?", userId, max(requiredAcks, 1)); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec("DELETE FROM data_acks WHERE recipient = ? AND "+blobDeleted, userId)
+		return err
+	})
+}
+
+// InsertData stores the blob unless it would exceed quota, in a single statement so concurrent inserts can't both fit.
+func (s *SQLiteStorage) InsertData(dataBlob []byte, ackId []byte, recipientId string, expiresAt int64, quota storage.MailboxQuota) error {
+	now := time.Now().Unix()
+	res, err := s.execRetry(`INSERT INTO data (recipient, ack_id, data_blob, expires_at) SELECT ?, ?, ?, ? WHERE `+quotaCondition,
+		recipientId, ackId, dataBlob, nullableExpiry(expiresAt),
+		quota.MaxMessages, recipientId, now, quota.MaxMessages,
+		quota.MaxBytes, recipientId, now, len(dataBlob), quota.MaxBytes)
+	if err != nil {
+		return err
+	}
 
+	inserted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if inserted == 0 {
+		return fmt.Errorf("%w: (%s)", storage.ErrMailboxFull, recipientId)
+	}
+	return nil
+}
+
+// quotaCondition holds when a blob fits in the recipient's quota, its arguments are the message limit, recipient and
+// current time, then the byte limit, recipient, current time and blob size.
+const quotaCondition = `(? = 0 OR (SELECT COUNT(*) FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?)) < ?)
+		AND (? = 0 OR (SELECT COALESCE(SUM(LENGTH(data_blob)), 0) FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?)) + ? <= ?)`
+
+func (s *SQLiteStorage) PurgeExpiredData(now int64) (int64, error) {
+	var purged int64
+	err := s.inTx(func(tx *sql.Tx) error {
+		// The acknowledgements go along with their blobs.
+		if _, err := tx.Exec(`DELETE FROM data_acks WHERE (recipient, ack_id) IN (SELECT recipient, ack_id FROM data WHERE expires_at IS NOT NULL AND expires_at <= ?)`, now); err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`DELETE FROM data WHERE expires_at IS NOT NULL AND expires_at <= ?`, now)
+		if err != nil {
+			return err
+		}
+
+		purged, err = res.RowsAffected()
+		return err
+	})
+	return purged, err
+}
+
+// GetMailboxUsage returns the size and number of undelivered blobs stored for userId.
+func (s *SQLiteStorage) GetMailboxUsage(userId string) (int64, int64, error) {
+	var (
+		totalBytes int64
+		count      int64
+		err        error
+	)
+	for {
+		err = s.Db.QueryRow("SELECT COALESCE(SUM(LENGTH(data_blob)), 0), COUNT(*) FROM data WHERE recipient = ? AND (expires_at IS NULL OR expires_at > ?)", userId, time.Now().Unix()).Scan(&totalBytes, &count)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
+	return totalBytes, count, err
+}
+
+// GetTotalUsage returns the size and number of undelivered blobs stored for every user.
+func (s *SQLiteStorage) GetTotalUsage() (int64, int64, error) {
+	var (
+		totalBytes int64
+		count      int64
+		err        error
+	)
+	for {
+		err = s.Db.QueryRow("SELECT COALESCE(SUM(LENGTH(data_blob)), 0), COUNT(*) FROM data WHERE expires_at IS NULL OR expires_at > ?", time.Now().Unix()).Scan(&totalBytes, &count)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
+	return totalBytes, count, err
+}
+
+// nullableExpiry stores "never expires" as NULL.
+func nullableExpiry(expiresAt int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: expiresAt, Valid: expiresAt != 0}
+}
+
+func (s *SQLiteStorage) EnqueueOutbound(msg storage.OutboundMessage) error {
+	var err error
 	for {
-		query := fmt.Sprintf("DELETE FROM data WHERE recipient = ? AND ack_id IN (%s)", strings.Join(placeholders, ","))
-		_, err = s.Db.Exec(query, args...)
+		_, err = s.Db.Exec(`INSERT INTO outbound (url, sender, recipient, data_blob, message_id, created_at, attempts, next_attempt) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			msg.Url, msg.Sender, msg.Recipient, msg.Blob, msg.MessageId, msg.CreatedAt, msg.Attempts, msg.NextAttempt)
 		if isSQLiteBusy(err) {
 			continue
 		}
@@ -257,10 +640,65 @@ func (s *SQLiteStorage) DeleteAck(userId string, acks [][]byte) error {
 	return err
 }
 
-func (s *SQLiteStorage) InsertData(dataBlob []byte, ackId []byte, recipientId string) error {
+func (s *SQLiteStorage) GetDueOutbound(now int64, limit int) ([]storage.OutboundMessage, error) {
+	rows, err := s.Db.Query(`SELECT id, url, sender, recipient, data_blob, message_id, created_at, attempts, next_attempt FROM outbound WHERE next_attempt <= ? ORDER BY next_attempt LIMIT ?`, now, limit)
+	if err != nil {
+		if isSQLiteBusy(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	var msgs []storage.OutboundMessage
+	for rows.Next() {
+		var msg storage.OutboundMessage
+		if err := rows.Scan(&msg.Id, &msg.Url, &msg.Sender, &msg.Recipient, &msg.Blob, &msg.MessageId, &msg.CreatedAt, &msg.Attempts, &msg.NextAttempt); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		if isSQLiteBusy(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// ClaimOutbound reschedules the message only if nobody else did since we fetched it,
+// so that concurrent workers never deliver the same message twice.
+func (s *SQLiteStorage) ClaimOutbound(id int64, nextAttempt int64, attempts int, retryAt int64) (bool, error) {
+	var (
+		res sql.Result
+		err error
+	)
+	for {
+		res, err = s.Db.Exec(`UPDATE outbound SET attempts = ?, next_attempt = ? WHERE id = ? AND next_attempt = ?`, attempts, retryAt, id, nextAttempt)
+		if isSQLiteBusy(err) {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+func (s *SQLiteStorage) DeleteOutbound(id int64) error {
 	var err error
 	for {
-		_, err = s.Db.Exec(`INSERT INTO data (recipient, ack_id, data_blob) VALUES (?, ?, ?)`, recipientId, ackId, dataBlob)
+		_, err = s.Db.Exec(`DELETE FROM outbound WHERE id = ?`, id)
 		if isSQLiteBusy(err) {
 			continue
 		}
@@ -269,6 +707,214 @@ func (s *SQLiteStorage) InsertData(dataBlob []byte, ackId []byte, recipientId st
 	return err
 }
 
+// MarkFederationMessageSeen records a message received from url, and returns false if it was already recorded.
+func (s *SQLiteStorage) MarkFederationMessageSeen(url string, messageId []byte, expiresAt int64) (bool, error) {
+	res, err := s.execRetry(`INSERT OR IGNORE INTO federation_seen (url, message_id, expires_at) VALUES (?, ?, ?)`, url, messageId, expiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// UnmarkFederationMessageSeen forgets a message that could not be stored, so that its retry is accepted.
+func (s *SQLiteStorage) UnmarkFederationMessageSeen(url string, messageId []byte) error {
+	_, err := s.execRetry(`DELETE FROM federation_seen WHERE url = ? AND message_id = ?`, url, messageId)
+	return err
+}
+
+func (s *SQLiteStorage) PurgeExpiredFederationMessages(now int64) (int64, error) {
+	res, err := s.execRetry(`DELETE FROM federation_seen WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Administration
+
+func (s *SQLiteStorage) ListUsers() ([]string, error) {
+	rows, err := s.Db.Query(`SELECT id FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// DeleteUser deletes the user, its devices and pending challenges, and keeps its ID from being reissued until reservedUntil.
+// It returns false if the user did not exist.
+func (s *SQLiteStorage) DeleteUser(id string, reservedUntil int64) (bool, error) {
+	var deleted bool
+	err := s.inTx(func(tx *sql.Tx) error {
+		deleted = false
+
+		if _, err := tx.Exec(`DELETE FROM challenges WHERE id = ?`, id); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`DELETE FROM devices WHERE user_id = ?`, id); err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(`DELETE FROM users WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+
+		affected, err := res.RowsAffected()
+		if err != nil || affected == 0 {
+			return err
+		}
+		deleted = true
+
+		_, err = tx.Exec(`INSERT INTO reserved_user_ids (id, reserved_until) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET reserved_until = excluded.reserved_until`, id, reservedUntil)
+		return err
+	})
+	return deleted, err
+}
+
+// IsUserIdReserved reports whether id belonged to a user deleted less than the reuse cooldown ago.
+func (s *SQLiteStorage) IsUserIdReserved(id string, now int64) (bool, error) {
+	var reserved bool
+	err := s.Db.QueryRow(`SELECT EXISTS(SELECT 1 FROM reserved_user_ids WHERE id = ? AND reserved_until > ?)`, id, now).Scan(&reserved)
+	return reserved, err
+}
+
+// PurgeExpiredReservations frees the IDs of deleted users whose cooldown is over.
+func (s *SQLiteStorage) PurgeExpiredReservations(now int64) (int64, error) {
+	res, err := s.execRetry(`DELETE FROM reserved_user_ids WHERE reserved_until <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// SetUserBan bans the user since bannedAt, or lifts the ban if bannedAt is 0. It returns false if the user does not exist.
+func (s *SQLiteStorage) SetUserBan(id string, bannedAt int64) (bool, error) {
+	res, err := s.execRetry(`UPDATE users SET banned_at = ? WHERE id = ?`, sql.NullInt64{Int64: bannedAt, Valid: bannedAt != 0}, id)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// GetUserBan returns when the user was banned, 0 if it isn't.
+func (s *SQLiteStorage) GetUserBan(id string) (int64, error) {
+	var bannedAt sql.NullInt64
+	err := s.Db.QueryRow(`SELECT banned_at FROM users WHERE id = ?`, id).Scan(&bannedAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return bannedAt.Int64, err
+}
+
+func (s *SQLiteStorage) ListServers() ([]storage.ServerInfo, error) {
+	rows, err := s.Db.Query(`SELECT url, public_key, refetch_date FROM servers ORDER BY url`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var servers []storage.ServerInfo
+	for rows.Next() {
+		var server storage.ServerInfo
+		if err := rows.Scan(&server.Url, &server.PublicKey, &server.RefetchDate); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	return servers, rows.Err()
+}
+
+// DeleteServerInfo forgets a federated server's key, it is fetched again on its next request.
+func (s *SQLiteStorage) DeleteServerInfo(url string) (bool, error) {
+	res, err := s.execRetry(`DELETE FROM servers WHERE url = ?`, url)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// PurgeMailbox deletes every blob stored for userId, expired or not.
+func (s *SQLiteStorage) PurgeMailbox(userId string) (int64, error) {
+	res, err := s.execRetry(`DELETE FROM data WHERE recipient = ?`, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := s.execRetry(`DELETE FROM data_acks WHERE recipient = ?`, userId); err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Devices
+
+func (s *SQLiteStorage) AddDevice(userId string, deviceId string, publicKey []byte, createdAt int64) error {
+	_, err := s.execRetry(`INSERT INTO devices (user_id, id, public_key, created_at) VALUES (?, ?, ?, ?)`, userId, deviceId, publicKey, createdAt)
+	return err
+}
+
+// GetDevicePublicKey returns nil if the device is not registered to the user.
+func (s *SQLiteStorage) GetDevicePublicKey(userId string, deviceId string) ([]byte, error) {
+	var publicKey []byte
+	err := s.Db.QueryRow(`SELECT public_key FROM devices WHERE user_id = ? AND id = ?`, userId, deviceId).Scan(&publicKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return publicKey, err
+}
+
+func (s *SQLiteStorage) ListDevices(userId string) ([]storage.Device, error) {
+	rows, err := s.Db.Query(`SELECT id, public_key, created_at FROM devices WHERE user_id = ? ORDER BY created_at, id`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []storage.Device
+	for rows.Next() {
+		var device storage.Device
+		if err := rows.Scan(&device.Id, &device.PublicKey, &device.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+// RemoveDevice returns false if the device was not registered to the user.
+func (s *SQLiteStorage) RemoveDevice(userId string, deviceId string) (bool, error) {
+	res, err := s.execRetry(`DELETE FROM devices WHERE user_id = ? AND id = ?`, userId, deviceId)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
 // Shared methods by UserStorage and DataStorage
 
 func (s *SQLiteStorage) CheckUserIdExists(id string) (bool, error) {
@@ -280,6 +926,11 @@ func (s *SQLiteStorage) CheckUserIdExists(id string) (bool, error) {
 	return exists, nil
 }
 
+// HealthCheck pings the database.
+func (s *SQLiteStorage) HealthCheck(ctx context.Context) error {
+	return s.Db.PingContext(ctx)
+}
+
 func (s *SQLiteStorage) ExitCleanup() error {
 	return s.Db.Close()
 }
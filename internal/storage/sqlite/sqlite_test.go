@@ -2,8 +2,13 @@ package sqlite
 
 import (
 	"bytes"
-	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
+	"context"
+	"errors"
 	"testing"
+	"time"
+
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/storage"
+	"github.com/Freedom-Club-Sec/Coldwire-server/internal/utils"
 )
 
 func TestNewUserAndPublicKeyRetrieve(t *testing.T) {
@@ -50,3 +55,678 @@ func TestNewUserAndPublicKeyRetrieve(t *testing.T) {
 		t.Fatalf("nilPublicKey is not nil: %v", nilPublicKey)
 	}
 }
+
+func TestGetDataSince(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	for _, blob := range blobs {
+		ackId, err := utils.SecureRandomBytes(32)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.InsertData(blob, ackId, recipient, 0, storage.MailboxQuota{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Data for other recipients must never be returned
+	if err := store.InsertData([]byte("other"), make([]byte, 32), "0000000000000000", 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := store.GetDataSince(recipient, "primary", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != len(blobs) {
+		t.Fatalf("expected %d records, got %d", len(blobs), len(records))
+	}
+
+	for i, record := range records {
+		if !bytes.Equal(record.Blob, blobs[i]) {
+			t.Fatalf("record %d blob mismatch: %q", i, record.Blob)
+		}
+	}
+
+	resumed, err := store.GetDataSince(recipient, "primary", records[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resumed) != 2 || resumed[0].Id != records[1].Id {
+		t.Fatalf("resuming after %d returned unexpected records: %v", records[0].Id, resumed)
+	}
+}
+
+func TestOutboundQueueClaim(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.EnqueueOutbound(storage.OutboundMessage{
+		Url:         "example.com",
+		Sender:      "1111111111111111",
+		Recipient:   "2222222222222222",
+		Blob:        []byte("signed blob"),
+		MessageId:   bytes.Repeat([]byte{1}, 16),
+		CreatedAt:   100,
+		Attempts:    1,
+		NextAttempt: 130,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := store.GetDueOutbound(129, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("message returned before it is due: %v", msgs)
+	}
+
+	msgs, err = store.GetDueOutbound(130, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || !bytes.Equal(msgs[0].Blob, []byte("signed blob")) {
+		t.Fatalf("unexpected due messages: %v", msgs)
+	}
+
+	claimed, err := store.ClaimOutbound(msgs[0].Id, msgs[0].NextAttempt, 2, 190)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Fatal("first claim failed")
+	}
+
+	// A second worker holding the same stale row must not claim it again.
+	claimed, err = store.ClaimOutbound(msgs[0].Id, msgs[0].NextAttempt, 2, 190)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed {
+		t.Fatal("stale claim succeeded")
+	}
+
+	if err := store.DeleteOutbound(msgs[0].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err = store.GetDueOutbound(1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Fatalf("deleted message still queued: %v", msgs)
+	}
+}
+
+func TestExpiredDataIsHiddenAndPurged(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	if err := store.InsertData([]byte("expired"), make([]byte, 32), recipient, now-1, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.InsertData([]byte("fresh"), bytes.Repeat([]byte{1}, 32), recipient, now+3600, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.InsertData([]byte("forever"), bytes.Repeat([]byte{2}, 32), recipient, 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := store.GetDataSince(recipient, "primary", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || string(records[0].Blob) != "fresh" || string(records[1].Blob) != "forever" {
+		t.Fatalf("expired data was returned: %v", records)
+	}
+
+	totalBytes, count, err := store.GetMailboxUsage(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if totalBytes != int64(len("fresh")+len("forever")) || count != 2 {
+		t.Fatalf("mailbox usage counted expired data: %d bytes, %d messages", totalBytes, count)
+	}
+
+	if err := store.InsertData([]byte("other"), bytes.Repeat([]byte{3}, 32), "other recipient", 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	totalBytes, count, err = store.GetTotalUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if totalBytes != int64(len("fresh")+len("forever")+len("other")) || count != 3 {
+		t.Fatalf("total usage is wrong: %d bytes, %d messages", totalBytes, count)
+	}
+
+	purged, err := store.PurgeExpiredData(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Fatalf("expected 1 purged blob, got %d", purged)
+	}
+}
+
+func TestInsertDataEnforcesQuota(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quota := storage.MailboxQuota{MaxBytes: 10, MaxMessages: 2}
+
+	if err := store.InsertData([]byte("hello"), bytes.Repeat([]byte{1}, 32), recipient, 0, quota); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.InsertData([]byte("too large"), bytes.Repeat([]byte{2}, 32), recipient, 0, quota); !errors.Is(err, storage.ErrMailboxFull) {
+		t.Fatalf("blob exceeding the byte quota was stored: %v", err)
+	}
+
+	if err := store.InsertData([]byte("world"), bytes.Repeat([]byte{3}, 32), recipient, 0, quota); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.InsertData([]byte("!"), bytes.Repeat([]byte{4}, 32), recipient, 0, storage.MailboxQuota{MaxMessages: 2}); !errors.Is(err, storage.ErrMailboxFull) {
+		t.Fatalf("blob exceeding the message quota was stored: %v", err)
+	}
+
+	if _, count, err := store.GetMailboxUsage(recipient); err != nil || count != 2 {
+		t.Fatalf("expected 2 stored blobs, got %d (%v)", count, err)
+	}
+}
+
+func TestChallengeIsConsumedOnce(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	publicKey, err := utils.SecureRandomBytes(2592)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, err := utils.SecureRandomBytes(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiredChallenge, err := utils.SecureRandomBytes(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveChallenge(challenge, nil, publicKey, now, now+300); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveChallenge(expiredChallenge, nil, publicKey, now-600, now-300); err != nil {
+		t.Fatal(err)
+	}
+
+	fetchedPublicKey, userId, err := store.ConsumeChallenge(challenge, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fetchedPublicKey, publicKey) || userId != "" {
+		t.Fatalf("unexpected challenge data: userId %q", userId)
+	}
+
+	if _, _, err := store.ConsumeChallenge(challenge, now); err != storage.ErrChallengeNotFound {
+		t.Fatalf("challenge was consumed twice: %v", err)
+	}
+
+	if _, _, err := store.ConsumeChallenge(expiredChallenge, now); err != storage.ErrChallengeNotFound {
+		t.Fatalf("expired challenge was accepted: %v", err)
+	}
+
+	purged, err := store.PurgeExpiredChallenges(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Fatalf("expected 1 purged challenge, got %d", purged)
+	}
+}
+
+func TestTokenRevocation(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	userId, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := utils.SecureRandomBytes(2592)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveUser(userId, publicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := store.RevokeToken("a", now+60)
+	if err != nil || !revoked {
+		t.Fatalf("token was not revoked: %v", err)
+	}
+
+	if revoked, err := store.RevokeToken("a", now+60); err != nil || revoked {
+		t.Fatalf("token was revoked twice: %v", err)
+	}
+
+	if revoked, err := store.IsTokenRevoked("a", userId, now); err != nil || !revoked {
+		t.Fatalf("revoked token was accepted: %v", err)
+	}
+
+	if revoked, err := store.IsTokenRevoked("b", userId, now); err != nil || revoked {
+		t.Fatalf("valid token was rejected: %v", err)
+	}
+
+	if err := store.RevokeUserTokens(userId, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked, err := store.IsTokenRevoked("b", userId, now-1); err != nil || !revoked {
+		t.Fatalf("token issued before revoking all sessions was accepted: %v", err)
+	}
+
+	if revoked, err := store.IsTokenRevoked("c", userId, now); err != nil || revoked {
+		t.Fatalf("token issued after revoking all sessions was rejected: %v", err)
+	}
+
+	purged, err := store.PurgeExpiredRevocations(now + 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Fatalf("expected 1 purged revocation, got %d", purged)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.HealthCheck(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.ExitCleanup()
+
+	if err := store.HealthCheck(context.Background()); err == nil {
+		t.Fatal("closed database passed the health check")
+	}
+}
+
+func TestUserAdministration(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	userId, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := utils.SecureRandomBytes(2592)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveUser(userId, publicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := store.ListUsers()
+	if err != nil || len(ids) != 1 || ids[0] != userId {
+		t.Fatalf("unexpected users %v: %v", ids, err)
+	}
+
+	if exists, err := store.SetUserBan(userId, now); err != nil || !exists {
+		t.Fatalf("user was not banned: %v", err)
+	}
+
+	if bannedAt, err := store.GetUserBan(userId); err != nil || bannedAt != now {
+		t.Fatalf("expected ban at %d, got %d: %v", now, bannedAt, err)
+	}
+
+	if exists, err := store.SetUserBan(userId, 0); err != nil || !exists {
+		t.Fatalf("ban was not lifted: %v", err)
+	}
+
+	if bannedAt, err := store.GetUserBan(userId); err != nil || bannedAt != 0 {
+		t.Fatalf("user is still banned since %d: %v", bannedAt, err)
+	}
+
+	if err := store.InsertData([]byte("hello"), make([]byte, 32), userId, 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if purged, err := store.PurgeMailbox(userId); err != nil || purged != 1 {
+		t.Fatalf("expected 1 purged blob, got %d: %v", purged, err)
+	}
+
+	if deleted, err := store.DeleteUser(userId, now+60); err != nil || !deleted {
+		t.Fatalf("user was not deleted: %v", err)
+	}
+
+	if reserved, err := store.IsUserIdReserved(userId, now); err != nil || !reserved {
+		t.Fatalf("deleted user ID is not reserved: %v", err)
+	}
+
+	if purged, err := store.PurgeExpiredReservations(now + 60); err != nil || purged != 1 {
+		t.Fatalf("expected 1 purged reservation, got %d: %v", purged, err)
+	}
+
+	if reserved, err := store.IsUserIdReserved(userId, now); err != nil || reserved {
+		t.Fatalf("user ID is still reserved after the cooldown: %v", err)
+	}
+
+	if revoked, err := store.IsTokenRevoked("a", userId, now); err != nil || !revoked {
+		t.Fatalf("token of a deleted user was accepted: %v", err)
+	}
+
+	if exists, err := store.SetUserBan(userId, now); err != nil || exists {
+		t.Fatalf("deleted user was banned: %v", err)
+	}
+
+	if err := store.SaveServerInfo("example.com", publicKey, "2026-01-01"); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, err := store.ListServers()
+	if err != nil || len(servers) != 1 || servers[0].Url != "example.com" {
+		t.Fatalf("unexpected servers %v: %v", servers, err)
+	}
+
+	if deleted, err := store.DeleteServerInfo("example.com"); err != nil || !deleted {
+		t.Fatalf("server was not forgotten: %v", err)
+	}
+}
+
+func TestUpdateUserPublicKey(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userId, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPublicKey, err := utils.SecureRandomBytes(2592)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPublicKey, err := utils.SecureRandomBytes(2592)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveUser(userId, oldPublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if updated, err := store.UpdateUserPublicKey(userId, oldPublicKey, newPublicKey); err != nil || !updated {
+		t.Fatalf("public-key was not updated: %v", err)
+	}
+
+	fetchedPublicKey, err := store.GetUserPublicKeyById(userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(fetchedPublicKey, newPublicKey) {
+		t.Fatal("public-key was not replaced")
+	}
+
+	if updated, err := store.UpdateUserPublicKey(userId, oldPublicKey, oldPublicKey); err != nil || updated {
+		t.Fatalf("public-key was updated from a stale key: %v", err)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userId, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := utils.SecureRandomBytes(2592)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devicePublicKey, err := utils.SecureRandomBytes(2592)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveUser(userId, publicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+
+	if err := store.AddDevice(userId, "laptop", devicePublicKey, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.AddDevice(userId, "phone", devicePublicKey, now); err == nil {
+		t.Fatal("public-key was registered to two devices")
+	}
+
+	devices, err := store.ListDevices(userId)
+	if err != nil || len(devices) != 1 || devices[0].Id != "laptop" || !bytes.Equal(devices[0].PublicKey, devicePublicKey) {
+		t.Fatalf("unexpected devices %v: %v", devices, err)
+	}
+
+	// Challenges issued for a device verify with the device's key, not the user's.
+	challenge, err := utils.SecureRandomBytes(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveChallenge(challenge, userId, devicePublicKey, now, now+60); err != nil {
+		t.Fatal(err)
+	}
+
+	fetchedPublicKey, fetchedUserId, err := store.ConsumeChallenge(challenge, now)
+	if err != nil || fetchedUserId != userId || !bytes.Equal(fetchedPublicKey, devicePublicKey) {
+		t.Fatalf("device challenge returned the wrong key or user (%s): %v", fetchedUserId, err)
+	}
+
+	if removed, err := store.RemoveDevice(userId, "laptop"); err != nil || !removed {
+		t.Fatalf("device was not removed: %v", err)
+	}
+
+	if fetchedPublicKey, err := store.GetDevicePublicKey(userId, "laptop"); err != nil || fetchedPublicKey != nil {
+		t.Fatalf("removed device still has a public-key: %v", err)
+	}
+
+	if removed, err := store.RemoveDevice(userId, "laptop"); err != nil || removed {
+		t.Fatalf("device was removed twice: %v", err)
+	}
+}
+
+func TestAckRequiresEveryDevice(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recipient, err := utils.RandomUserId()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := bytes.Repeat([]byte{1}, 32)
+	second := bytes.Repeat([]byte{2}, 32)
+
+	if err := store.InsertData([]byte("first"), first, recipient, 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.InsertData([]byte("second"), second, recipient, 0, storage.MailboxQuota{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteAck(recipient, "primary", [][]byte{first, second}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Acknowledged by the primary device only, so the laptop still receives both.
+	if data, err := store.GetLatestData(recipient, "primary"); err != nil || len(data) != 0 {
+		t.Fatalf("acknowledged data was returned again: %v", err)
+	}
+
+	records, err := store.GetDataSince(recipient, "laptop", 0)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("expected 2 records for the other device, got %d: %v", len(records), err)
+	}
+
+	if err := store.DeleteAck(recipient, "laptop", [][]byte{first}, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, count, err := store.GetMailboxUsage(recipient); err != nil || count != 1 {
+		t.Fatalf("expected only the blob acknowledged by every device to be deleted, %d left: %v", count, err)
+	}
+
+	// Once the laptop is removed, the primary device alone is enough.
+	if err := store.RemoveDeviceAcks(recipient, "laptop", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, count, err := store.GetMailboxUsage(recipient); err != nil || count != 0 {
+		t.Fatalf("blob acknowledged by every remaining device was kept, %d left: %v", count, err)
+	}
+
+	var acks int
+	if err := store.Db.QueryRow(`SELECT COUNT(*) FROM data_acks WHERE recipient = ?`, recipient).Scan(&acks); err != nil || acks != 0 {
+		t.Fatalf("acknowledgements outlived their blobs, %d left: %v", acks, err)
+	}
+}
+
+func TestFederationMessageSeen(t *testing.T) {
+	store, err := New(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageId := []byte("0123456789abcdef")
+
+	firstSeen, err := store.MarkFederationMessageSeen("example.com", messageId, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstSeen {
+		t.Fatal("new message reported as already seen")
+	}
+
+	firstSeen, err = store.MarkFederationMessageSeen("example.com", messageId, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if firstSeen {
+		t.Fatal("replayed message was not detected")
+	}
+
+	firstSeen, err = store.MarkFederationMessageSeen("example.org", messageId, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstSeen {
+		t.Fatal("same message ID from another server reported as already seen")
+	}
+
+	if err := store.UnmarkFederationMessageSeen("example.org", messageId); err != nil {
+		t.Fatal(err)
+	}
+
+	firstSeen, err = store.MarkFederationMessageSeen("example.org", messageId, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !firstSeen {
+		t.Fatal("forgotten message reported as already seen")
+	}
+
+	purged, err := store.PurgeExpiredFederationMessages(199)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Fatalf("purged %d messages before they expired", purged)
+	}
+
+	purged, err = store.PurgeExpiredFederationMessages(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 2 {
+		t.Fatalf("expected 2 purged messages, got %d", purged)
+	}
+}
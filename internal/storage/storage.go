@@ -1,20 +1,123 @@
 package storage
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrChallengeNotFound is returned by ConsumeChallenge for unknown, expired or already consumed challenges.
+var ErrChallengeNotFound = errors.New("Challenge does not exist or has expired")
+
+// ErrMailboxFull is returned by InsertData when the blob would exceed the recipient's quota.
+var ErrMailboxFull = errors.New("Recipient mailbox is full")
+
 type UserStorage interface {
 	SaveUser(id string, publicKey []byte) error
+	UpdateUserPublicKey(id string, oldPublicKey []byte, newPublicKey []byte) (bool, error)
 	CheckUserIdExists(id string) (bool, error)
 	GetUserPublicKeyById(id string) ([]byte, error)
-	SaveChallenge(challenge []byte, id interface{}, publicKey interface{}) error
+	SaveChallenge(challenge []byte, id interface{}, publicKey interface{}, createdAt int64, expiresAt int64) error
 	SaveServerInfo(url string, publicKey []byte, refetchDate string) error
 	GetServerInfo(url string) ([]byte, string, error)
-	GetChallengeData(challenge []byte) ([]byte, string, error)
+	ConsumeChallenge(challenge []byte, now int64) ([]byte, string, error)
 	ExitCleanup() error
 	CleanupChallenges() error
+	PurgeExpiredChallenges(now int64) (int64, error)
+	RevokeToken(jti string, expiresAt int64) (bool, error)
+	RevokeUserTokens(userId string, issuedBefore int64) error
+	IsTokenRevoked(jti string, userId string, issuedAt int64) (bool, error)
+	PurgeExpiredRevocations(now int64) (int64, error)
+	ListUsers() ([]string, error)
+	DeleteUser(id string, reservedUntil int64) (bool, error)
+	IsUserIdReserved(id string, now int64) (bool, error)
+	PurgeExpiredReservations(now int64) (int64, error)
+	SetUserBan(id string, bannedAt int64) (bool, error)
+	GetUserBan(id string) (int64, error)
+	ListServers() ([]ServerInfo, error)
+	DeleteServerInfo(url string) (bool, error)
+	AddDevice(userId string, deviceId string, publicKey []byte, createdAt int64) error
+	GetDevicePublicKey(userId string, deviceId string) ([]byte, error)
+	ListDevices(userId string) ([]Device, error)
+	RemoveDevice(userId string, deviceId string) (bool, error)
+}
+
+// Device is an additional device registered to a user, the key the user registered with is not stored as one.
+type Device struct {
+	Id        string
+	PublicKey []byte
+	CreatedAt int64
 }
 
+// ServerInfo is the cached identity of a federated server.
+type ServerInfo struct {
+	Url         string
+	PublicKey   []byte
+	RefetchDate string
+}
+
+// DataStorage timestamps are unix seconds, an expiresAt of 0 means the data is kept until acknowledged.
+// Blobs are fetched per device, and only deleted once requiredAcks distinct devices acknowledged them.
 type DataStorage interface {
-	GetLatestData(userId string) ([]byte, error)
-	DeleteAck(userId string, acks [][]byte) error
-	InsertData(data []byte, ackId []byte, recipientId string) error
+	GetLatestData(userId string, deviceId string) ([]byte, error)
+	DeleteAck(userId string, deviceId string, acks [][]byte, requiredAcks int) error
+	RemoveDeviceAcks(userId string, deviceId string, requiredAcks int) error
+	InsertData(data []byte, ackId []byte, recipientId string, expiresAt int64, quota MailboxQuota) error
+	PurgeExpiredData(now int64) (int64, error)
+	GetMailboxUsage(userId string) (totalBytes int64, count int64, err error)
+	GetTotalUsage() (totalBytes int64, count int64, err error)
+	PurgeMailbox(userId string) (int64, error)
+	EnqueueOutbound(msg OutboundMessage) error
+	GetDueOutbound(now int64, limit int) ([]OutboundMessage, error)
+	ClaimOutbound(id int64, nextAttempt int64, attempts int, retryAt int64) (bool, error)
+	DeleteOutbound(id int64) error
+	MarkFederationMessageSeen(url string, messageId []byte, expiresAt int64) (bool, error)
+	UnmarkFederationMessageSeen(url string, messageId []byte) error
+	PurgeExpiredFederationMessages(now int64) (int64, error)
 	ExitCleanup() error
 }
+
+// OutboundMessage is a federation message waiting to be delivered to a remote server.
+// Blob is unsigned, it is signed again with a fresh timestamp on every attempt, under the same MessageId.
+// Timestamps are unix seconds.
+type OutboundMessage struct {
+	Id          int64
+	Url         string
+	Sender      string
+	Recipient   string
+	Blob        []byte
+	MessageId   []byte
+	CreatedAt   int64
+	Attempts    int
+	NextAttempt int64
+}
+
+// Notifier fans out "new data for recipient" events across server instances sharing the same storage.
+// Listen calls onNotify with an empty recipient ID when notifications may have been missed, e.g. after a reconnect.
+type Notifier interface {
+	Publish(recipientId string) error
+	Listen(ctx context.Context, onNotify func(recipientId string)) error
+}
+
+// MailboxQuota limits the undelivered data of a recipient, checked and enforced atomically with every insert.
+// Sizes don't include ack IDs, a zero limit is unlimited.
+type MailboxQuota struct {
+	MaxBytes    int64
+	MaxMessages int64
+}
+
+// DataRecord is a single stored blob, Id orders blobs by insertion.
+type DataRecord struct {
+	Id    int64
+	AckId []byte
+	Blob  []byte
+}
+
+// DataStreamer is implemented by DataStorage backends with an ordered row ID, which lets streams resume after a given blob.
+type DataStreamer interface {
+	GetDataSince(userId string, deviceId string, afterId int64) ([]DataRecord, error)
+}
+
+// HealthChecker is implemented by storage backends that can check their connection is usable.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
@@ -3,6 +3,8 @@ package types
 type AuthenticateInitRequest struct {
 	PublicKey string `json:"public_key"`
 	UserID    string `json:"user_id"`
+	// Device of UserID the challenge is for, the primary device if empty.
+	DeviceID string `json:"device_id,omitempty"`
 }
 
 type AuthenticateInitResponse struct {
@@ -12,25 +14,118 @@ type AuthenticateInitResponse struct {
 type AuthenticateVerificationRequest struct {
 	Challenge string `json:"challenge"`
 	Signature string `json:"signature"`
+	// Must match the device_id the challenge was requested for.
+	DeviceID string `json:"device_id,omitempty"`
 }
 
 type AuthenticateVerificationResponse struct {
-	UserID string `json:"user_id"`
-	Token  string `json:"token"`
+	UserID       string `json:"user_id"`
+	DeviceID     string `json:"device_id"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	// Seconds until Token expires.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+// AuthenticateRotateKeyRequest replaces a user's public-key, the challenge must be issued for the user's ID.
+// Signature and NewSignature are made by the current and the new key, over the challenge followed by NewPublicKey.
+type AuthenticateRotateKeyRequest struct {
+	Challenge    string `json:"challenge"`
+	NewPublicKey string `json:"new_public_key"`
+	Signature    string `json:"signature"`
+	NewSignature string `json:"new_signature"`
+}
+
+type AuthenticateRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type AuthenticateRevokeRequest struct {
+	// Optional refresh token of the current session, revoked along with the access token.
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// Revokes every session of the user instead.
+	All bool `json:"all"`
+}
+
+// AccountDeleteRequest carries a signature over a challenge issued by /authenticate/init for the user's ID.
+type AccountDeleteRequest struct {
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+}
+
+// DeviceAddRequest registers a new device, the challenge must be issued by /authenticate/init for the new device's
+// public-key, and signed by it.
+type DeviceAddRequest struct {
+	Challenge string `json:"challenge"`
+	Signature string `json:"signature"`
+}
+
+type DeviceAddResponse struct {
+	DeviceID string `json:"device_id"`
+}
+
+type DeviceRemoveRequest struct {
+	DeviceID string `json:"device_id"`
+}
+
+type DeviceInfo struct {
+	DeviceID string `json:"device_id"`
+	// SHA-256 of the device's public-key, hex encoded.
+	Fingerprint string `json:"fingerprint"`
+	// Unix time the device was added, 0 for the primary device.
+	CreatedAt int64 `json:"created_at"`
+}
+
+type DeviceListResponse struct {
+	Devices []DeviceInfo `json:"devices"`
 }
 
 type FederationInfoResponse struct {
 	PublicKey   []byte `json:"public_key"`
 	RefetchDate string `json:"refetch_date"`
 	Signature   []byte `json:"signature"`
+	// Lets peers that pinned an older key follow the server to PublicKey, oldest rotation first.
+	KeyRotations []FederationKeyRotation `json:"key_rotations,omitempty"`
+}
+
+// FederationKeyRotation announces that a server replaced PreviousPublicKey by PublicKey, signed by PreviousPublicKey.
+type FederationKeyRotation struct {
+	PreviousPublicKey []byte `json:"previous_public_key"`
+	PublicKey         []byte `json:"public_key"`
+	Signature         []byte `json:"signature"`
 }
 
 type FederationSendRequest struct {
 	Recipient string `json:"recipient"`
 	Sender    string `json:"sender"`
 	Url       string `json:"url"`
+	// Unix seconds at which the message was signed, and a random hex ID, both covered by the signature.
+	Timestamp int64  `json:"timestamp"`
+	MessageId string `json:"message_id"`
 }
 
 type DataSendRequest struct {
 	Recipient string `json:"recipient"`
+	// Seconds until undelivered data is deleted, optional, capped by the server's maximum retention.
+	TTL int64 `json:"ttl,omitempty"`
+}
+
+type DataAckRequest struct {
+	Acks []string `json:"acks"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type ReadinessResponse struct {
+	// "ready" when every storage is usable, "unavailable" otherwise.
+	Status      string        `json:"status"`
+	UserStorage StorageHealth `json:"user_storage"`
+	DataStorage StorageHealth `json:"data_storage"`
+}
+
+type StorageHealth struct {
+	Backend string `json:"backend"`
+	Status  string `json:"status"`
 }